@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Prompter asks for the value of a start argument that was not provided on the
+// command line. problem will be not-nil if the previous value entered was not
+// valid.
+type Prompter func(argument *VariableDefinition, problem error) (string, error)
+
+// ParseStartArguments converts the command line arguments into the values for
+// the arguments of the start function. Arguments are provided in the form:
+//
+//   --days 7 --customer 123
+//   --days=7 --customer=123
+//
+// Any missing arguments will be asked for with prompt. If prompt is nil then a
+// missing argument is an error.
+func ParseStartArguments(start *Function, args []string, prompt Prompter) ([]interface{}, error) {
+	provided, err := parseArgumentFlags(args)
+	if err != nil {
+		return nil, err
+	}
+
+	var arguments []*VariableDefinition
+	if start != nil {
+		arguments = start.Arguments()
+	}
+
+	var values []interface{}
+	for _, argument := range arguments {
+		raw, ok := provided[argument.Name]
+		delete(provided, argument.Name)
+
+		if !ok {
+			if prompt == nil {
+				return nil, fmt.Errorf("missing argument --%s (%s)",
+					argument.Name, argument.Type)
+			}
+
+			// Keep asking until a valid value is entered.
+			var problem error
+			for {
+				raw, err = prompt(argument, problem)
+				if err != nil {
+					return nil, err
+				}
+
+				_, problem = newValueFromText(argument, raw)
+				if problem == nil {
+					break
+				}
+			}
+		}
+
+		value, err := newValueFromText(argument, raw)
+		if err != nil {
+			return nil, fmt.Errorf("--%s: %v", argument.Name, err)
+		}
+
+		values = append(values, value)
+	}
+
+	if len(provided) > 0 {
+		var names []string
+		for name := range provided {
+			names = append(names, "--"+name)
+		}
+		sort.Strings(names)
+
+		return nil, fmt.Errorf("unknown argument %s", strings.Join(names, ", "))
+	}
+
+	return values, nil
+}
+
+func parseArgumentFlags(args []string) (map[string]string, error) {
+	provided := map[string]string{}
+
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "--") {
+			return nil, fmt.Errorf("expected an argument like --name, "+
+				"but got %s", args[i])
+		}
+
+		name := strings.TrimPrefix(args[i], "--")
+		value := ""
+
+		if parts := strings.SplitN(name, "=", 2); len(parts) == 2 {
+			name, value = parts[0], parts[1]
+		} else {
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("missing value for --%s", name)
+			}
+
+			i++
+			value = args[i]
+		}
+
+		provided[strings.ToLower(name)] = value
+	}
+
+	return provided, nil
+}
+
+// newValueFromText converts text from outside of the program into a value
+// suitable for the variable.
+func newValueFromText(variable *VariableDefinition, s string) (interface{}, error) {
+	switch variable.Type {
+	case VariableTypeText:
+		return NewText(s), nil
+
+	case VariableTypeNumber:
+		return ParseNumber(s, variable.Precision)
+	}
+
+	return nil, errors.New(variable.Type + " cannot be set from text")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+var startArgumentsTests = map[string]struct {
+	args     []string
+	prompts  []string
+	expected []interface{}
+	err      string
+}{
+	"Separate": {
+		args:     []string{"--days", "7", "--customer", "123"},
+		expected: []interface{}{NewNumber("7", 0), NewText("123")},
+	},
+	"Equals": {
+		args:     []string{"--customer=Bob", "--days=14"},
+		expected: []interface{}{NewNumber("14", 0), NewText("Bob")},
+	},
+	"Missing": {
+		args: []string{"--days", "7"},
+		err:  "missing argument --customer (text)",
+	},
+	"Unknown": {
+		args: []string{"--days", "7", "--customer", "1", "--foo", "bar"},
+		err:  "unknown argument --foo",
+	},
+	"MissingValue": {
+		args: []string{"--customer", "1", "--days"},
+		err:  "missing value for --days",
+	},
+	"NotANumber": {
+		args: []string{"--days", "seven", "--customer", "1"},
+		err:  `--days: "seven" is not a number`,
+	},
+	"TooManyDecimalPlaces": {
+		args: []string{"--days", "7.5", "--customer", "1"},
+		err:  "--days: 7.5 has more than 0 decimal places",
+	},
+	"Prompt": {
+		args:     []string{"--customer", "Bob"},
+		prompts:  []string{"seven", "7"},
+		expected: []interface{}{NewNumber("7", 0), NewText("Bob")},
+	},
+}
+
+func TestParseStartArguments(t *testing.T) {
+	parser := NewParser(strings.NewReader(
+		"start (days is number with 0 decimal places, customer is text):"))
+	program, err := parser.Parse()
+	require.NoError(t, err)
+
+	for testName, test := range startArgumentsTests {
+		t.Run(testName, func(t *testing.T) {
+			var prompt Prompter
+			var problems []error
+			if test.prompts != nil {
+				prompts := test.prompts
+				prompt = func(argument *VariableDefinition, problem error) (string, error) {
+					problems = append(problems, problem)
+					if len(prompts) == 0 {
+						return "", errors.New("no more prompts")
+					}
+
+					answer := prompts[0]
+					prompts = prompts[1:]
+
+					return answer, nil
+				}
+			}
+
+			values, err := ParseStartArguments(program.Functions["start"],
+				test.args, prompt)
+
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, test.expected, values)
+			}
+
+			if test.prompts != nil {
+				assert.Equal(t, []error{
+					nil, errors.New(`"seven" is not a number`),
+				}, problems)
+			}
+		})
+	}
+}
@@ -22,6 +22,47 @@ type Statement interface{}
 // executed.
 type Program struct {
 	Functions map[string]*Function
+
+	// Variables are declared at the top of the file, before any functions.
+	// They exist for the whole run and can be used from every function.
+	Variables []*VariableDefinition
+
+	// Constants are also defined at the top of the file. They cannot be
+	// changed.
+	Constants []*ConstantDefinition
+
+	// UsesTry is true if "try" is used anywhere in the program. The error
+	// variables only exist when it is, but they can be used in any function. They are not part of Variables
+	// because they are owned by the virtual machine.
+	UsesTry bool
+}
+
+func (program *Program) AppendVariable(definition *VariableDefinition) {
+	program.Variables = append(program.Variables, definition)
+}
+
+func (program *Program) AppendConstant(constant *ConstantDefinition) {
+	program.Constants = append(program.Constants, constant)
+}
+
+func (program *Program) Constant(name string) *ConstantDefinition {
+	for _, constant := range program.Constants {
+		if constant.Name == name {
+			return constant
+		}
+	}
+
+	return nil
+}
+
+func (program *Program) VariableMap() map[string]*VariableDefinition {
+	m := make(map[string]*VariableDefinition)
+
+	for _, variable := range program.Variables {
+		m[variable.Name] = variable
+	}
+
+	return m
 }
 
 func (program *Program) AppendFunction(fn *Function) {
@@ -50,12 +91,20 @@ func (fn *Function) VariableMap() map[string]*VariableDefinition {
 	return m
 }
 
-func (fn *Function) AppendArgument(name, ty string) {
-	fn.Variables = append(fn.Variables, &VariableDefinition{
-		Name:       name,
-		Type:       ty,
-		LocalScope: false,
-	})
+func (fn *Function) AppendArgument(definition *VariableDefinition) {
+	definition.LocalScope = false
+	fn.Variables = append(fn.Variables, definition)
+}
+
+// Arguments are the variables that are not declared inside the function.
+func (fn *Function) Arguments() (arguments []*VariableDefinition) {
+	for _, variable := range fn.Variables {
+		if !variable.LocalScope {
+			arguments = append(arguments, variable)
+		}
+	}
+
+	return
 }
 
 func (fn *Function) AppendVariable(definition *VariableDefinition) {
@@ -97,11 +146,46 @@ func (sentence *Sentence) Args() (args []interface{}) {
 	return
 }
 
+// String is the sentence as it would be written, such as
+// `display "total: " total`.
+func (sentence *Sentence) String() string {
+	var words []string
+
+	for _, word := range sentence.Words {
+		words = append(words, wordString(word))
+	}
+
+	return strings.Join(words, " ")
+}
+
+func wordString(word interface{}) string {
+	switch w := word.(type) {
+	case string:
+		return w
+
+	case VariableReference:
+		return string(w)
+
+	case *string:
+		return `"` + *w + `"`
+
+	case *Number:
+		return w.String()
+	}
+
+	return "?"
+}
+
 type Condition struct {
 	Left, Right interface{}
 	Operator    string
 }
 
+func (condition *Condition) String() string {
+	return wordString(condition.Left) + " " + condition.Operator + " " +
+		wordString(condition.Right)
+}
+
 type If struct {
 	// Unless is true if "unless" was used instead of "if". This inverts the
 	// logic.
@@ -129,6 +213,36 @@ type While struct {
 	True *Sentence
 }
 
+type ForEach struct {
+	// Variable receives each value before Body is run.
+	Variable VariableReference
+
+	// Source describes what is being iterated over. It is the remainder of
+	// the sentence after the variable, like "in file ?" or "matching ?".
+	Source *Sentence
+
+	// Body is run once for each value. Like While, this is a sentence because
+	// it makes no sense to allow yes/no answers here.
+	Body *Sentence
+}
+
+// Try runs a sentence and, if it fails, runs OnFailure instead of stopping the
+// program. Finally is always run last. Either OnFailure or Finally (or both)
+// will be provided.
+type Try struct {
+	Try       *Sentence
+	OnFailure *Sentence
+	Finally   *Sentence
+}
+
+// Assert stops the program with an assertion failure if the condition or
+// question is not true.
+type Assert struct {
+	// Either Condition or Question will be not-nil, never both.
+	Condition *Condition
+	Question  *Sentence
+}
+
 type QuestionAnswer struct {
 	Yes bool
 }
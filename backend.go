@@ -2,39 +2,181 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"math/rand"
-	"net"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Backend struct {
 	Name      string
 	Path      string // directory of the backend
-	Port      int
-	Conn      net.Conn
-	Sentences []string
+	Conn      io.ReadWriteCloser
+	Sentences []*BackendSentence
 	Config    *BackendConfiguration
+
+	// reader must be kept between responses because it may have already
+	// read the start of the next one.
+	reader *bufio.Reader
+
+	// transport is created when the backend is started.
+	transport transport
+
+	// cmd is the running process, or nil when the backend is not running.
+	cmd *exec.Cmd
+
+	// done is closed once the process has exited.
+	done chan struct{}
+
+	// stderr is everything the backend has written to stderr. It is included
+	// in the error if the backend does not start.
+	stderr *lockedBuffer
+
+	// waiting is true while a request has been sent, but the final response
+	// has not been received. A callback cannot send another request to the
+	// same backend in that time.
+	waiting bool
+
+	// mutex guards waiting, Conn, reader, cmd, done and transport once the
+	// backend has started, because the backend may be closed from another
+	// goroutine when bento is interrupted.
+	mutex sync.Mutex
 }
 
+// BackendShutdownTimeout is how long a backend has to exit by itself after
+// being asked to shut down. After that, it is killed.
+var BackendShutdownTimeout = 5 * time.Second
+
 type BackendRequest struct {
-	Sentence string   `json:"sentence"`
-	Args     []string `json:"args"`
+	Sentence string `json:"sentence"`
+
+	// Args are text, except for arguments that have the "number" type which
+	// are JSON numbers.
+	Args []interface{} `json:"args"`
 }
 
 type BackendResponse struct {
-	Text  string            `json:"text"`
-	Set   map[string]string `json:"set"`
-	Error string            `json:"error"`
+	Text  string                  `json:"text"`
+	Set   map[string]BackendValue `json:"set"`
+	Error *BackendError           `json:"error"`
+
+	// Callback is a sentence that the backend wants to run before it sends
+	// the final response, such as "display ?". The Args are the values for
+	// each placeholder.
+	Callback string         `json:"callback"`
+	Args     []BackendValue `json:"args"`
+
+	// Progress (from 0 to 1) and the Message describing it are shown while
+	// the sentence is running. Output is a line of output to show. Bento does
+	// not reply to either of them.
+	Progress *float64 `json:"progress"`
+	Message  string   `json:"message"`
+	Output   *string  `json:"output"`
 }
 
-type BackendConfiguration struct {
-	Run string
+// BackendCallbackResult is sent to the backend after running a callback.
+type BackendCallbackResult struct {
+	// Answer is the answer to a question. It is always false for other
+	// sentences.
+	Answer bool `json:"answer"`
+
+	// Set has the value of each argument after the callback has run, like the
+	// "set" in a response. The keys are "$0", "$1", etc. Text is a string and
+	// a number is a JSON number.
+	Set   map[string]interface{} `json:"set,omitempty"`
+	Error string                 `json:"error,omitempty"`
+}
+
+// BackendValue is a value in "set". It can be text or a JSON number, which is
+// kept exactly as it was written.
+type BackendValue string
+
+func (value *BackendValue) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, (*string)(value))
+	}
+
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return fmt.Errorf("value must be text or a number, but got %s", data)
+	}
+
+	*value = BackendValue(number)
+
+	return nil
+}
+
+// BackendError is the "error" in a response. It can be only the message, or an
+// object with more information about the error:
+//
+//	{"error": "customer not found"}
+//	{"error": {"message": "customer not found", "code": "not-found"}}
+type BackendError struct {
+	Message string `json:"message"`
+
+	// Code is a short name for the kind of error, such as "not-found". It
+	// allows a program to handle some errors differently from others.
+	Code string `json:"code"`
+
+	// Retryable is true when the same sentence may work if it is tried again
+	// later, such as when a database is unavailable.
+	Retryable bool `json:"retryable"`
+
+	// Details is any extra JSON that is useful for debugging. It is only
+	// logged, it is never available to the program.
+	Details json.RawMessage `json:"details"`
+}
+
+func (err *BackendError) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &err.Message)
+	}
+
+	// The alias is needed so that this function is not called recursively.
+	type backendError BackendError
+
+	return json.Unmarshal(data, (*backendError)(err))
+}
+
+func (err *BackendError) Error() string {
+	if err.Message == "" {
+		return fmt.Sprintf("backend returned error code %q", err.Code)
+	}
+
+	return err.Message
+}
+
+// failed is true if the response contains an error. An empty error is the same
+// as no error.
+func (response *BackendResponse) failed() bool {
+	return response.Error != nil &&
+		(response.Error.Message != "" || response.Error.Code != "")
+}
+
+// lockedBuffer collects the output of a backend while it is running.
+type lockedBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (buffer *lockedBuffer) Write(p []byte) (int, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return buffer.buffer.Write(p)
+}
+
+func (buffer *lockedBuffer) String() string {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+
+	return buffer.buffer.String()
 }
 
 func NewBackend(name string) *Backend {
@@ -44,67 +186,219 @@ func NewBackend(name string) *Backend {
 }
 
 func (backend *Backend) connect() (err error) {
-	to := fmt.Sprintf("127.0.0.1:%d", backend.Port)
-	backend.Conn, err = net.Dial("tcp", to)
+	backend.Conn, err = backend.transport.connect()
+	backend.reader = nil
 
 	return
 }
 
-func (backend *Backend) sendRaw(body string) (string, error) {
-	_, err := fmt.Fprintln(backend.Conn, body)
-	if err != nil {
-		fmt.Printf("%s ! %v\n", backend.Name, err)
+// sendRaw sends a single line and waits for the response. A zero timeout
+// uses whatever deadline has already been set on the connection.
+func (backend *Backend) sendRaw(body string, timeout time.Duration) (string, error) {
+	if err := backend.write(body); err != nil {
 		return "", err
 	}
 
-	response, err := bufio.NewReader(backend.Conn).ReadString('\n')
-	if err != nil {
-		return "", err
+	return backend.receive(timeout)
+}
+
+func (backend *Backend) write(body string) error {
+	conn, _ := backend.connection()
+	if conn == nil {
+		return fmt.Errorf("backend %s is not running", backend.Name)
 	}
 
-	return response, err
+	_, err := fmt.Fprintln(conn, body)
+
+	return err
 }
 
-func (backend *Backend) send(request *BackendRequest) (*BackendResponse, error) {
-	jsonData, err := json.Marshal(request)
-	if err != nil {
-		return nil, err
+// receive reads the next line from the backend. If nothing is received before
+// the timeout the backend is killed because it may never respond.
+func (backend *Backend) receive(timeout time.Duration) (string, error) {
+	conn, reader := backend.connection()
+	if conn == nil {
+		return "", fmt.Errorf("backend %s is not running", backend.Name)
 	}
 
-	responseData, err := backend.sendRaw(string(jsonData))
-	if err != nil {
-		return nil, err
+	if timeout == 0 {
+		return reader.ReadString('\n')
+	}
+
+	setReadDeadline(conn, time.Now().Add(timeout))
+	line, err := reader.ReadString('\n')
+
+	if err, ok := err.(interface{ Timeout() bool }); ok && err.Timeout() {
+		return "", backend.timedOut(timeout)
+	}
+
+	setReadDeadline(conn, time.Time{})
+
+	return line, err
+}
+
+// connection returns nil if the backend is not running. The connection is
+// not used while holding the lock, so that it can be closed by another
+// goroutine while a response is being read. The read then fails.
+func (backend *Backend) connection() (io.ReadWriteCloser, *bufio.Reader) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if backend.reader == nil && backend.Conn != nil {
+		backend.reader = bufio.NewReader(backend.Conn)
+	}
+
+	return backend.Conn, backend.reader
+}
+
+// isRunning is false once the connection has been closed.
+func (backend *Backend) isRunning() bool {
+	conn, _ := backend.connection()
+
+	return conn != nil
+}
+
+// timedOut kills the backend and returns the error for the sentence. The code
+// allows a program to tell a timeout apart from other errors.
+func (backend *Backend) timedOut(timeout time.Duration) error {
+	err := &BackendError{
+		Message: fmt.Sprintf("backend %s did not respond within %v, so it "+
+			"was stopped", backend.Name, timeout),
+		Code: "timeout",
+	}
+
+	if killErr := backend.kill(); killErr != nil {
+		err.Message += ": " + killErr.Error()
+	}
+
+	return err
+}
+
+// requestTimeout is how long to wait for each message from the backend while
+// it handles the sentence. The sentence is empty for special requests.
+func (backend *Backend) requestTimeout(syntax string) time.Duration {
+	if sentence := backend.sentence(syntax); sentence != nil &&
+		sentence.Timeout > 0 {
+		return seconds(sentence.Timeout)
+	}
+
+	if backend.Config != nil && backend.Config.RequestTimeout > 0 {
+		return seconds(backend.Config.RequestTimeout)
+	}
+
+	return DefaultBackendRequestTimeout
+}
+
+func (backend *Backend) isWaiting() bool {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	return backend.waiting
+}
+
+func (backend *Backend) setWaiting(waiting bool) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	backend.waiting = waiting
+}
+
+// send sends the request and waits for the final response. Before that, the
+// backend may send any number of interim messages (callbacks, progress and
+// output). Each one is passed to interim. Only callbacks are replied to, with
+// the result returned by interim.
+func (backend *Backend) send(request *BackendRequest,
+	interim func(*BackendResponse) *BackendCallbackResult) (*BackendResponse, error) {
+	if backend.isWaiting() {
+		return nil, fmt.Errorf("backend %s cannot be used by a callback "+
+			"because it is waiting for the callback to finish", backend.Name)
 	}
 
-	var response *BackendResponse
-	err = json.Unmarshal([]byte(responseData), &response)
+	jsonData, err := json.Marshal(request)
 	if err != nil {
 		return nil, err
 	}
 
-	return response, nil
+	backend.setWaiting(true)
+	defer backend.setWaiting(false)
+
+	timeout := backend.requestTimeout(request.Sentence)
+	for {
+		if jsonData != nil {
+			if err := backend.write(string(jsonData)); err != nil {
+				return nil, err
+			}
+		}
+
+		responseData, err := backend.receive(timeout)
+		if err != nil {
+			return nil, err
+		}
+
+		var response *BackendResponse
+		err = json.Unmarshal([]byte(responseData), &response)
+		if err != nil {
+			return nil, err
+		}
+
+		jsonData = nil
+		switch {
+		// A response must always be an object, even if it is empty.
+		case response == nil:
+			return nil, fmt.Errorf("backend %s sent an invalid response: %s",
+				backend.Name, strings.TrimSpace(responseData))
+
+		case response.Callback != "":
+			result := &BackendCallbackResult{
+				Error: "callbacks are not supported for this request",
+			}
+			if interim != nil {
+				result = interim(response)
+			}
+
+			jsonData, err = json.Marshal(result)
+			if err != nil {
+				return nil, err
+			}
+
+		case response.Progress != nil || response.Output != nil:
+			if interim != nil {
+				interim(response)
+			}
+
+		default:
+			return response, nil
+		}
+	}
 }
 
 func (backend *Backend) loadSentences() error {
-	response, err := backend.sendRaw(`{"special":"sentences"}`)
+	// The deadline is set by waitUntilReady.
+	response, err := backend.sendRaw(`{"special":"sentences"}`, 0)
 	if err != nil {
 		return err
 	}
 
 	var parsedResponse struct {
-		Sentences []string
+		Sentences []*BackendSentence
 	}
 	err = json.Unmarshal([]byte(response), &parsedResponse)
 	if err != nil {
 		return err
 	}
 
+	err = validateBackendSentences(parsedResponse.Sentences)
+	if err != nil {
+		return err
+	}
+
 	backend.Sentences = parsedResponse.Sentences
 
 	return nil
 }
 
-func (backend *Backend) backendDirectories() []string {
+// backendDirectories are searched in order for backends.
+func backendDirectories() []string {
 	directories := os.Getenv("BENTO_BACKEND")
 	if directories == "" {
 		// Default to the current directory if none are provided.
@@ -114,80 +408,210 @@ func (backend *Backend) backendDirectories() []string {
 	return strings.Split(directories, ":")
 }
 
+// findBackendPaths returns every directory for the backend, in the order that
+// they would be used. A directory is only a backend if it contains a
+// bento.json.
+func findBackendPaths(dirs []string, name string) (paths []string) {
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		fs, err := os.Stat(filepath.Join(path, "bento.json"))
+		if err == nil && !fs.IsDir() {
+			paths = append(paths, path)
+		}
+	}
+
+	return
+}
+
 func (backend *Backend) findBackend() error {
 	// We always use the first backend that matches the name. Even if there are
 	// other backends by the same name that would have otherwise been discovered
 	// in the future.
-	dirs := backend.backendDirectories()
-	for _, dir := range dirs {
-		path := fmt.Sprintf("%s/%s", dir, backend.Name)
-		fs, err := os.Stat(path)
-		if err == nil && fs.IsDir() {
-			backend.Path = path
-			return nil
-		}
+	dirs := backendDirectories()
+	if paths := findBackendPaths(dirs, backend.Name); len(paths) > 0 {
+		backend.Path = paths[0]
+
+		return nil
 	}
 
 	return fmt.Errorf("no such backend %s in any path: %s",
 		backend.Name, strings.Join(dirs, ":"))
 }
 
-func (backend *Backend) readBentoConfig() error {
-	data, err := ioutil.ReadFile(backend.Path + "/bento.json")
+func (backend *Backend) Start() error {
+	err := backend.findBackend()
 	if err != nil {
 		return err
 	}
 
-	err = json.Unmarshal(data, &backend.Config)
+	backend.Config, err = readBackendConfiguration(
+		filepath.Join(backend.Path, "bento.json"))
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
-
-func (backend *Backend) Start() error {
-	err := backend.findBackend()
+	backend.transport, err = newTransport(backend.Config.Transport)
 	if err != nil {
 		return err
 	}
 
-	err = backend.readBentoConfig()
+	// It starts in the background, in its own process group so that the
+	// backend and anything it starts can be killed together. Anything written
+	// to stderr is passed through for logging.
+	cmd := backend.Config.command(backend.Path)
+	backend.stderr = &lockedBuffer{}
+	cmd.Stderr = io.MultiWriter(os.Stderr, backend.stderr)
+	setProcessGroup(cmd)
+
+	err = backend.transport.prepare(cmd)
 	if err != nil {
 		return err
 	}
 
-	// TODO: Need a more reliable way to pick the port.
-	backend.Port = 50000 + rand.Intn(1000)
-
-	// TODO: This is problematic for arguments that have spaces.
-	cmdParts := strings.Split(backend.Config.Run, " ")
-
-	// It starts in the background.
-	cmd := exec.Command(cmdParts[0], cmdParts[1:]...)
-	cmd.Env = append(cmd.Env, fmt.Sprintf("BENTO_PORT=%d", backend.Port))
-	cmd.Dir = backend.Path
-
 	if err := cmd.Start(); err != nil {
+		backend.transport.cleanup()
+
 		return err
 	}
 
-	// TODO: Remove this?
-	time.Sleep(time.Second)
+	backend.cmd = cmd
+	backend.done = make(chan struct{})
+	go func(done chan struct{}) {
+		_ = cmd.Wait()
+		close(done)
+	}(backend.done)
 
-	err = backend.connect()
+	err = backend.waitUntilReady(backend.Config.startupTimeout())
 	if err != nil {
-		return err
+		// The stderr is the most likely place to find out what went wrong.
+		if stderr := strings.TrimSpace(backend.stderr.String()); stderr != "" {
+			err = fmt.Errorf("%v\n%s", err, stderr)
+		}
+
+		_ = backend.Close()
+
+		return fmt.Errorf("backend %s did not start: %v", backend.Name, err)
 	}
 
-	err = backend.loadSentences()
+	return nil
+}
+
+// waitUntilReady keeps trying to connect (waiting a little longer each time)
+// until the backend responds to the "sentences" request, the process exits or
+// the timeout is reached.
+func (backend *Backend) waitUntilReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	delay := 10 * time.Millisecond
+
+	for {
+		err := backend.connect()
+		if err == nil {
+			// A backend that accepts the connection but never responds is
+			// also not ready.
+			setDeadline(backend.Conn, deadline)
+			err = backend.loadSentences()
+			setDeadline(backend.Conn, time.Time{})
+
+			return err
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			return fmt.Errorf("not ready after %v: %v", timeout, err)
+		}
+
+		select {
+		case <-backend.done:
+			return fmt.Errorf("exited with %v", backend.cmd.ProcessState)
+
+		case <-time.After(delay):
+		}
+
+		if delay *= 2; delay > 500*time.Millisecond {
+			delay = 500 * time.Millisecond
+		}
+	}
+}
+
+// Close asks the backend to shut down and waits for the process to exit. If it
+// does not exit within BackendShutdownTimeout the process (and anything else
+// in its process group) is killed. A request that is still waiting for a
+// response (such as when bento is interrupted) is cancelled first.
+func (backend *Backend) Close() error {
+	var messages []string
+	if backend.isWaiting() {
+		messages = append(messages, `{"special":"cancel"}`)
+	}
+
+	backend.closeConn(append(messages, `{"special":"shutdown"}`)...)
+
+	return backend.stopProcess(BackendShutdownTimeout)
+}
+
+// kill cancels the request that the backend is handling and kills it without
+// waiting for it to shut down.
+func (backend *Backend) kill() error {
+	backend.closeConn(`{"special":"cancel"}`)
+
+	return backend.stopProcess(0)
+}
+
+// closeConn sends the messages (without waiting for a response) and closes the
+// connection.
+func (backend *Backend) closeConn(messages ...string) {
+	backend.mutex.Lock()
+	conn := backend.Conn
+	backend.Conn, backend.reader = nil, nil
+	backend.mutex.Unlock()
+
+	if conn == nil {
+		return
+	}
+
+	// The backend may not be listening any more, so it must not be able to
+	// stop bento from shutting down.
+	setDeadline(conn, time.Now().Add(BackendShutdownTimeout))
+	for _, message := range messages {
+		_, _ = fmt.Fprintln(conn, message)
+	}
+
+	_ = conn.Close()
+}
+
+// stopProcess waits for the process to exit, and kills it after the timeout.
+func (backend *Backend) stopProcess(timeout time.Duration) error {
+	backend.mutex.Lock()
+	cmd, done, transport := backend.cmd, backend.done, backend.transport
+	backend.cmd, backend.done, backend.transport = nil, nil, nil
+	backend.mutex.Unlock()
+
+	if cmd == nil {
+		return nil
+	}
+
+	defer transport.cleanup()
+
+	select {
+	case <-done:
+		return nil
+
+	case <-time.After(timeout):
+	}
+
+	err := killProcessGroup(cmd)
+	<-done
+
 	if err != nil {
-		return err
+		return fmt.Errorf("cannot kill backend %s: %v", backend.Name, err)
 	}
 
 	return nil
 }
 
+// sentence returns nil if the backend does not have the sentence.
+func (backend *Backend) sentence(syntax string) *BackendSentence {
+	return findBackendSentence(backend.Sentences, syntax)
+}
+
 func (backend *Backend) String() string {
 	return backend.Name
 }
@@ -2,29 +2,49 @@
 
 // This file is an example of a backend written in PHP.
 
+// Each variable is a separate instance, so they each have their own scores.
+// The first argument is always the ID of the instance.
 $handlers = [
-	'add ? to ?' => function($args) use (&$total, &$count) {
-        $total += $args[0];
-        ++$count;
+	'add ? to ?' => function($args) use (&$instances) {
+		$scores = &$instances[$args[1]];
+		$scores['total'] += $args[0];
+		++$scores['count'];
 	},
-	'average of ? into ?' => function($args) use (&$total, &$count) {
-		return ["set" => ['$1' => (string)($total / $count)]];
+	'average of ? into ?' => function($args) use (&$instances) {
+		$scores = $instances[$args[0]];
+		return ["set" => ['$1' => (string)($scores['total'] / $scores['count'])]];
 	},
-	'display ?' => function() use (&$total) {
-		return ["text" => "The total is $total."];
+	'display ?' => function($args) use (&$instances) {
+		return ["text" => "The total is {$instances[$args[0]]['total']}."];
 	}
 ];
 
 // The code following should not need to be changed.
 
+$instances = [];
+$nextID = 1;
+
 $socket = socket_create(AF_INET, SOCK_STREAM, 0);
-$result = socket_bind($socket, "127.0.0.1", $_ENV['BENTO_PORT']);
+$result = socket_bind($socket, "127.0.0.1", getenv('BENTO_PORT'));
 $result = socket_listen($socket, 3);
 $spawn = socket_accept($socket);
 
 while ($message = json_decode(socket_read($spawn, 65536, PHP_NORMAL_READ))) {
-    if ($message->special === "sentences") {
+    $special = isset($message->special) ? $message->special : null;
+
+    if ($special === "shutdown") {
+        break;
+    }
+
+    if ($special === "sentences") {
     	$result = ['sentences' => array_keys($handlers)];
+    } elseif ($special === "new") {
+    	$id = "scores-" . $nextID++;
+    	$instances[$id] = ['total' => 0, 'count' => 0];
+    	$result = ['id' => $id];
+    } elseif ($special === "destroy") {
+    	unset($instances[$message->id]);
+    	$result = null;
     } else {
     	$handler = $handlers[$message->sentence];
     	$result = $handler($message->args);
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackendConfiguration is the bento.json in the directory of a backend.
+type BackendConfiguration struct {
+	// Schema is only allowed so that editors can find bento.schema.json,
+	// which describes this file.
+	Schema string `json:"$schema"`
+
+	// Name, Version, Description and Author are only used to describe the
+	// backend, such as with "bento backends".
+	Name        string `json:"name"`
+	Version     string `json:"version"`
+	Description string `json:"description"`
+	Author      string `json:"author"`
+
+	// Help explains how to use each sentence. The key is the sentence, such
+	// as "add ? to ?".
+	Help map[string]string `json:"help"`
+
+	// Sentences are the same as the backend returns for the "sentences"
+	// request. They are optional, but allow sentences to be checked when the
+	// program is compiled, without starting the backend.
+	Sentences []*BackendSentence `json:"sentences"`
+
+	// Run is the program and its arguments.
+	Run BackendCommand `json:"run"`
+
+	// Platforms replaces the Run for specific operating systems. The keys are
+	// the same as GOOS, such as "windows" or "darwin".
+	Platforms map[string]BackendPlatform `json:"platforms"`
+
+	// Env is added to the environment that the backend inherits from bento.
+	// Each value may contain ${VAR} to use another environment variable.
+	Env map[string]string `json:"env"`
+
+	// WorkingDirectory is where the backend is started. A relative path is
+	// from the directory of the backend, which is also the default.
+	WorkingDirectory string `json:"working_directory"`
+
+	// Transport is how requests and responses are exchanged. It is "tcp" if
+	// not provided.
+	Transport string `json:"transport"`
+
+	// StartupTimeout is the number of seconds the backend has to become ready
+	// after it is started. DefaultBackendStartupTimeout is used if it is not
+	// provided.
+	StartupTimeout float64 `json:"startup_timeout"`
+
+	// RequestTimeout is the number of seconds to wait for each message from
+	// the backend while it is handling a sentence. A sentence may have its
+	// own timeout. DefaultBackendRequestTimeout is used if neither are
+	// provided.
+	RequestTimeout float64 `json:"request_timeout"`
+}
+
+// BackendPlatform is the configuration for a single operating system.
+type BackendPlatform struct {
+	Run BackendCommand `json:"run"`
+}
+
+// BackendCommand is the program and its arguments. It may be a single string
+// (split on spaces) or an array where each argument may contain spaces:
+//
+//	"run": "php scores.php"
+//	"run": ["php", "my scores.php"]
+type BackendCommand []string
+
+func (command *BackendCommand) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*command = strings.Fields(s)
+
+		return nil
+	}
+
+	var parts []string
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return errors.New(`"run" must be text or an array of text`)
+	}
+
+	*command = parts
+
+	return nil
+}
+
+// DefaultBackendStartupTimeout is used when the bento.json does not have a
+// "startup_timeout".
+const DefaultBackendStartupTimeout = 10 * time.Second
+
+// DefaultBackendRequestTimeout is used when neither the bento.json or the
+// sentence have a timeout.
+const DefaultBackendRequestTimeout = 5 * time.Minute
+
+// readBackendConfiguration reads and validates a bento.json. All errors
+// include the path of the file.
+func readBackendConfiguration(path string) (*BackendConfiguration, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := parseBackendConfiguration(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return config, nil
+}
+
+func parseBackendConfiguration(data []byte) (*BackendConfiguration, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	var config *BackendConfiguration
+	if err := decoder.Decode(&config); err != nil {
+		return nil, readableJSONError(err)
+	}
+
+	if config == nil {
+		return nil, errors.New("must be an object")
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// readableJSONError removes the Go details from errors that are caused by
+// mistakes in the bento.json.
+func readableJSONError(err error) error {
+	switch e := err.(type) {
+	case *json.UnmarshalTypeError:
+		return fmt.Errorf("%q must be %s, but got %s", e.Field,
+			configTypeName(e.Type.Kind().String()), e.Value)
+
+	case *json.SyntaxError:
+		return fmt.Errorf("invalid JSON at offset %d: %v", e.Offset, e)
+	}
+
+	// Unknown fields have no error type.
+	if strings.HasPrefix(err.Error(), "json: unknown field ") {
+		return fmt.Errorf("unknown option %s",
+			strings.TrimPrefix(err.Error(), "json: unknown field "))
+	}
+
+	return err
+}
+
+func configTypeName(kind string) string {
+	switch kind {
+	case "string":
+		return "text"
+
+	case "float64", "int":
+		return "a number"
+
+	case "map", "struct":
+		return "an object"
+	}
+
+	return kind
+}
+
+func (config *BackendConfiguration) validate() error {
+	if len(config.run()) == 0 {
+		return fmt.Errorf(`"run" is required (or "run" in "platforms" for %s)`,
+			runtime.GOOS)
+	}
+
+	for name, platform := range config.Platforms {
+		if len(platform.Run) == 0 {
+			return fmt.Errorf(`"run" is required for platform %q`, name)
+		}
+	}
+
+	for name := range config.Env {
+		if name == "" || strings.Contains(name, "=") {
+			return fmt.Errorf(`invalid "env" name %q`, name)
+		}
+	}
+
+	if err := validateBackendSentences(config.Sentences); err != nil {
+		return fmt.Errorf(`invalid "sentences": %v`, err)
+	}
+
+	if _, err := newTransport(config.Transport); err != nil {
+		return err
+	}
+
+	if config.StartupTimeout < 0 {
+		return fmt.Errorf(`"startup_timeout" must not be negative, but got %v`,
+			config.StartupTimeout)
+	}
+
+	if config.RequestTimeout < 0 {
+		return fmt.Errorf(`"request_timeout" must not be negative, but got %v`,
+			config.RequestTimeout)
+	}
+
+	return nil
+}
+
+func (config *BackendConfiguration) startupTimeout() time.Duration {
+	if config.StartupTimeout <= 0 {
+		return DefaultBackendStartupTimeout
+	}
+
+	return seconds(config.StartupTimeout)
+}
+
+// seconds converts a timeout from a bento.json.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// run is the command for the current operating system.
+func (config *BackendConfiguration) run() BackendCommand {
+	if platform, ok := config.Platforms[runtime.GOOS]; ok {
+		return platform.Run
+	}
+
+	return config.Run
+}
+
+// environment is the inherited environment with the "env" added. The names are
+// sorted so that the result is always the same.
+func (config *BackendConfiguration) environment(inherited []string) []string {
+	var names []string
+	for name := range config.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// Only the inherited environment can be expanded. Otherwise the result
+	// would depend on the order that the values are expanded.
+	lookup := map[string]string{}
+	for _, pair := range inherited {
+		if parts := strings.SplitN(pair, "=", 2); len(parts) == 2 {
+			lookup[parts[0]] = parts[1]
+		}
+	}
+
+	env := append([]string{}, inherited...)
+	for _, name := range names {
+		value := os.Expand(config.Env[name], func(name string) string {
+			return lookup[name]
+		})
+		env = append(env, name+"="+value)
+	}
+
+	return env
+}
+
+// command creates the process for a backend that is in dir. The process is not
+// started.
+func (config *BackendConfiguration) command(dir string) *exec.Cmd {
+	run := config.run()
+	cmd := exec.Command(run[0], run[1:]...)
+	cmd.Env = config.environment(os.Environ())
+
+	cmd.Dir = dir
+	if config.WorkingDirectory != "" {
+		cmd.Dir = config.WorkingDirectory
+		if !filepath.IsAbs(cmd.Dir) {
+			cmd.Dir = filepath.Join(dir, cmd.Dir)
+		}
+	}
+
+	return cmd
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var parseBackendConfigurationTests = map[string]struct {
+	json     string
+	expected *BackendConfiguration
+	err      string
+}{
+	"RunString": {
+		json: `{"run": "php  scores.php"}`,
+		expected: &BackendConfiguration{
+			Run: BackendCommand{"php", "scores.php"},
+		},
+	},
+	"RunArray": {
+		json: `{"run": ["php", "my scores.php"]}`,
+		expected: &BackendConfiguration{
+			Run: BackendCommand{"php", "my scores.php"},
+		},
+	},
+	"AllOptions": {
+		json: `{"run": "php scores.php", "env": {"DB": "${HOME}/db"}, ` +
+			`"working_directory": "src", "transport": "unix", ` +
+			`"startup_timeout": 2.5, "request_timeout": 60, ` +
+			`"platforms": {"windows": {"run": ["php.exe", "scores.php"]}}}`,
+		expected: &BackendConfiguration{
+			Run:              BackendCommand{"php", "scores.php"},
+			Env:              map[string]string{"DB": "${HOME}/db"},
+			WorkingDirectory: "src",
+			Transport:        "unix",
+			StartupTimeout:   2.5,
+			RequestTimeout:   60,
+			Platforms: map[string]BackendPlatform{
+				"windows": {Run: BackendCommand{"php.exe", "scores.php"}},
+			},
+		},
+	},
+	"OnlyPlatform": {
+		json: `{"platforms": {"` + runtime.GOOS + `": {"run": "scores"}}}`,
+		expected: &BackendConfiguration{
+			Platforms: map[string]BackendPlatform{
+				runtime.GOOS: {Run: BackendCommand{"scores"}},
+			},
+		},
+	},
+	"MissingRun": {
+		json: `{}`,
+		err: `"run" is required (or "run" in "platforms" for ` +
+			runtime.GOOS + `)`,
+	},
+	"EmptyRun": {
+		json: `{"run": []}`,
+		err: `"run" is required (or "run" in "platforms" for ` +
+			runtime.GOOS + `)`,
+	},
+	"RunIsNotText": {
+		json: `{"run": 123}`,
+		err:  `"run" must be text or an array of text`,
+	},
+	"MissingPlatformRun": {
+		json: `{"run": "scores", "platforms": {"windows": {}}}`,
+		err:  `"run" is required for platform "windows"`,
+	},
+	"UnknownOption": {
+		json: `{"run": "scores", "rnu": "scores"}`,
+		err:  `unknown option "rnu"`,
+	},
+	"WrongType": {
+		json: `{"run": "scores", "startup_timeout": "5"}`,
+		err:  `"startup_timeout" must be a number, but got string`,
+	},
+	"NegativeStartupTimeout": {
+		json: `{"run": "scores", "startup_timeout": -1}`,
+		err:  `"startup_timeout" must not be negative, but got -1`,
+	},
+	"NegativeRequestTimeout": {
+		json: `{"run": "scores", "request_timeout": -0.5}`,
+		err:  `"request_timeout" must not be negative, but got -0.5`,
+	},
+	"UnknownTransport": {
+		json: `{"run": "scores", "transport": "udp"}`,
+		err:  `unknown transport "udp"`,
+	},
+	"InvalidEnvName": {
+		json: `{"run": "scores", "env": {"A=B": "C"}}`,
+		err:  `invalid "env" name "A=B"`,
+	},
+	"NotAnObject": {
+		json: `null`,
+		err:  `must be an object`,
+	},
+	"InvalidJSON": {
+		json: `{"run": "scores",}`,
+		err: "invalid JSON at offset 18: " +
+			"invalid character '}' looking for beginning of object key string",
+	},
+}
+
+func TestParseBackendConfiguration(t *testing.T) {
+	for testName, test := range parseBackendConfigurationTests {
+		t.Run(testName, func(t *testing.T) {
+			config, err := parseBackendConfiguration([]byte(test.json))
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, test.expected, config)
+			}
+		})
+	}
+}
+
+func TestBackendConfiguration_Environment(t *testing.T) {
+	config := &BackendConfiguration{
+		Env: map[string]string{
+			"B":    "${HOME}/b",
+			"A":    "$HOME/a",
+			"HOME": "/home/other",
+			"C":    "${B}",
+		},
+	}
+
+	assert.Equal(t, []string{
+		"HOME=/home/bento",
+		"A=/home/bento/a",
+		"B=/home/bento/b",
+		"C=",
+		"HOME=/home/other",
+	}, config.environment([]string{"HOME=/home/bento"}))
+}
+
+func TestBackendConfiguration_Command(t *testing.T) {
+	dir := filepath.Join("backends", "scores")
+
+	for testName, test := range map[string]struct {
+		config *BackendConfiguration
+		args   []string
+		dir    string
+	}{
+		"Defaults": {
+			config: &BackendConfiguration{
+				Run: BackendCommand{"php", "my scores.php"},
+			},
+			args: []string{"php", "my scores.php"},
+			dir:  dir,
+		},
+		"Platform": {
+			config: &BackendConfiguration{
+				Run: BackendCommand{"php", "scores.php"},
+				Platforms: map[string]BackendPlatform{
+					runtime.GOOS: {Run: BackendCommand{"scores"}},
+				},
+			},
+			args: []string{"scores"},
+			dir:  dir,
+		},
+		"RelativeWorkingDirectory": {
+			config: &BackendConfiguration{
+				Run:              BackendCommand{"scores"},
+				WorkingDirectory: "src",
+			},
+			args: []string{"scores"},
+			dir:  filepath.Join(dir, "src"),
+		},
+		"AbsoluteWorkingDirectory": {
+			config: &BackendConfiguration{
+				Run:              BackendCommand{"scores"},
+				WorkingDirectory: os.TempDir(),
+			},
+			args: []string{"scores"},
+			dir:  os.TempDir(),
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			cmd := test.config.command(dir)
+
+			assert.Equal(t, test.args, cmd.Args)
+			assert.Equal(t, test.dir, cmd.Dir)
+			assert.Equal(t, os.Environ(), cmd.Env)
+		})
+	}
+}
+
+// jsonFields are the names of the fields of a struct in JSON.
+func jsonFields(value interface{}) (fields []string) {
+	ty := reflect.TypeOf(value)
+	for i := 0; i < ty.NumField(); i++ {
+		fields = append(fields,
+			strings.Split(ty.Field(i).Tag.Get("json"), ",")[0])
+	}
+	sort.Strings(fields)
+
+	return
+}
+
+// schemaAt follows the keys (or array indexes) in the schema.
+func schemaAt(t *testing.T, schema interface{}, path ...string) interface{} {
+	for _, key := range path {
+		switch s := schema.(type) {
+		case map[string]interface{}:
+			schema = s[key]
+
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			require.NoError(t, err)
+			schema = s[i]
+		}
+	}
+
+	return schema
+}
+
+// schemaProperties are the names of the properties of an object in the schema.
+func schemaProperties(t *testing.T, schema interface{}, path ...string) (properties []string) {
+	object, ok := schemaAt(t, schema, path...).(map[string]interface{})
+	require.True(t, ok, "%v is not an object", path)
+	assert.Equal(t, false, object["additionalProperties"], "%v", path)
+
+	for property := range object["properties"].(map[string]interface{}) {
+		properties = append(properties, property)
+	}
+	sort.Strings(properties)
+
+	return
+}
+
+// The schema is for editors and other tools. It must describe the same options
+// that are allowed by parseBackendConfiguration.
+func TestBackendConfiguration_Schema(t *testing.T) {
+	data, err := ioutil.ReadFile("bento.schema.json")
+	require.NoError(t, err)
+
+	var schema interface{}
+	require.NoError(t, json.Unmarshal(data, &schema))
+
+	assert.Equal(t, jsonFields(BackendConfiguration{}),
+		schemaProperties(t, schema))
+	assert.Equal(t, jsonFields(BackendPlatform{}), schemaProperties(t, schema,
+		"properties", "platforms", "additionalProperties"))
+	assert.Equal(t, jsonFields(BackendSentence{}), schemaProperties(t, schema,
+		"definitions", "sentence", "oneOf", "1"))
+
+	assert.Equal(t, []interface{}{TransportTCP, TransportUnix, TransportStdio},
+		schemaAt(t, schema, "properties", "transport", "enum"))
+
+	// The schema itself is a valid bento.json option.
+	_, err = parseBackendConfiguration([]byte(
+		`{"$schema": "../bento.schema.json", "run": "php scores.php"}`))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// BackendInstance is the value of a variable that has a backend type. All of
+// the variables for the same backend share one process, but each variable is a
+// separate instance in that process.
+type BackendInstance struct {
+	// Name is the name of the backend, which is also the type of the
+	// variable.
+	Name string
+
+	// ID is returned by the backend when the instance is created. It is
+	// empty if the backend does not support instances.
+	ID string
+
+	// backend is the process. It is nil until the instance is created.
+	backend *Backend
+
+	// declaredWith are the names of the backends of all the variables that
+	// were declared together (in the same function, or at the top of the
+	// file), including this one. They are started together.
+	declaredWith []string
+}
+
+func NewBackendInstance(name string) *BackendInstance {
+	return &BackendInstance{
+		Name: name,
+	}
+}
+
+// String is the handle that is sent to the backend for the variable. Backends
+// that do not support instances receive the name of the backend instead.
+func (instance *BackendInstance) String() string {
+	if instance.ID == "" {
+		return instance.Name
+	}
+
+	return instance.ID
+}
+
+// newInstance asks the backend to create an instance and returns its ID.
+func (backend *Backend) newInstance() (string, error) {
+	response, err := backend.sendRaw(`{"special":"new"}`,
+		backend.requestTimeout(""))
+	if err != nil {
+		return "", err
+	}
+
+	var parsedResponse struct {
+		ID    string        `json:"id"`
+		Error *BackendError `json:"error"`
+	}
+	err = json.Unmarshal([]byte(response), &parsedResponse)
+	if err != nil {
+		return "", err
+	}
+
+	if err := parsedResponse.Error; err != nil &&
+		(err.Message != "" || err.Code != "") {
+		return "", err
+	}
+
+	return parsedResponse.ID, nil
+}
+
+// destroyInstance tells the backend that the instance will never be used
+// again.
+func (backend *Backend) destroyInstance(id string) error {
+	data, err := json.Marshal(map[string]string{
+		"special": "destroy",
+		"id":      id,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = backend.sendRaw(string(data), backend.requestTimeout(""))
+	if err != nil {
+		return fmt.Errorf("cannot destroy %s instance %s: %v", backend.Name,
+			id, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// BackendListing describes a backend for "bento backends".
+type BackendListing struct {
+	Name string
+
+	// Path is the backend that is used. Shadowed are other backends with the
+	// same name that are never used because they are found later.
+	Path     string
+	Shadowed []string
+
+	Config    *BackendConfiguration
+	Sentences []*BackendSentence
+
+	// Err is set if the backend could not be read or started.
+	Err error
+}
+
+// findAllBackends returns every backend in dirs, sorted by name.
+func findAllBackends(dirs []string) (listings []*BackendListing) {
+	seen := map[string]bool{}
+
+	for _, dir := range dirs {
+		// A missing directory is not an error, in the same way that it is
+		// not for $PATH.
+		fileInfos, _ := ioutil.ReadDir(dir)
+
+		for _, fileInfo := range fileInfos {
+			name := fileInfo.Name()
+			if seen[name] || !fileInfo.IsDir() {
+				continue
+			}
+
+			paths := findBackendPaths(dirs, name)
+			if len(paths) == 0 {
+				continue
+			}
+
+			seen[name] = true
+			listings = append(listings, &BackendListing{
+				Name:     name,
+				Path:     paths[0],
+				Shadowed: paths[1:],
+			})
+		}
+	}
+
+	sort.Slice(listings, func(i, j int) bool {
+		return listings[i].Name < listings[j].Name
+	})
+
+	return
+}
+
+// load reads the bento.json and starts the backend to find its sentences.
+func (listing *BackendListing) load() {
+	listing.Config, listing.Err = readBackendConfiguration(
+		filepath.Join(listing.Path, "bento.json"))
+	if listing.Err != nil {
+		return
+	}
+
+	backend := NewBackend(listing.Name)
+	listing.Err = backend.Start()
+	if listing.Err != nil {
+		return
+	}
+
+	listing.Sentences = backend.Sentences
+	sort.Slice(listing.Sentences, func(i, j int) bool {
+		return listing.Sentences[i].Sentence < listing.Sentences[j].Sentence
+	})
+	listing.Err = backend.Close()
+}
+
+func (listing *BackendListing) write(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "%s (%s)\n", listing.Name, listing.Path)
+
+	if config := listing.Config; config != nil {
+		for _, field := range [][2]string{
+			{"name", config.Name},
+			{"version", config.Version},
+			{"description", config.Description},
+			{"author", config.Author},
+		} {
+			if field[1] != "" {
+				_, _ = fmt.Fprintf(w, "  %s: %s\n", field[0], field[1])
+			}
+		}
+	}
+
+	for _, path := range listing.Shadowed {
+		_, _ = fmt.Fprintf(w, "  shadowed: %s\n", path)
+	}
+
+	if listing.Err != nil {
+		// The error may be over several lines, such as when it includes the
+		// stderr of the backend.
+		_, _ = fmt.Fprintf(w, "  error: %s\n",
+			strings.Replace(listing.Err.Error(), "\n", "\n    ", -1))
+	}
+
+	if len(listing.Sentences) > 0 {
+		_, _ = fmt.Fprintln(w, "  sentences:")
+	}
+
+	for _, sentence := range listing.Sentences {
+		_, _ = fmt.Fprintf(w, "    %s\n", sentence.Signature())
+
+		if help := listing.Config.Help[sentence.Sentence]; help != "" {
+			_, _ = fmt.Fprintf(w, "      %s\n", help)
+		}
+	}
+}
+
+// listBackends writes every backend that can be found, with the sentences that
+// it provides. It returns false if any of the backends could not be started.
+func listBackends(w io.Writer) (ok bool) {
+	ok = true
+
+	for i, listing := range findAllBackends(backendDirectories()) {
+		if i > 0 {
+			_, _ = fmt.Fprintln(w)
+		}
+
+		listing.load()
+		listing.write(w)
+
+		if listing.Err != nil {
+			ok = false
+		}
+	}
+
+	return
+}
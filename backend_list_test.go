@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestListBackends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bento")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "first")
+	second := filepath.Join(dir, "second")
+
+	config := helperBackendConfig("tcp")
+	config["name"] = "Ping"
+	config["version"] = "1.2.3"
+	config["description"] = "Answers every sentence."
+	config["author"] = "Bob"
+	config["help"] = map[string]string{"ping ?": "Says pong."}
+	writeHelperBackend(t, first, "pinger", config)
+
+	writeHelperBackend(t, second, "pinger", helperBackendConfig("tcp"))
+	writeHelperBackend(t, second, "broken", map[string]interface{}{})
+	writeHelperBackend(t, second, "plain", helperBackendConfig("stdio"))
+
+	// Directories without a bento.json are not backends.
+	require.NoError(t, os.Mkdir(filepath.Join(first, "other"), 0755))
+
+	previous := os.Getenv("BENTO_BACKEND")
+	defer os.Setenv("BENTO_BACKEND", previous)
+	require.NoError(t, os.Setenv("BENTO_BACKEND",
+		first+":"+filepath.Join(dir, "missing")+":"+second))
+
+	out := bytes.NewBuffer(nil)
+	ok := listBackends(out)
+
+	assert.False(t, ok)
+	assert.Equal(t, `broken (SECOND/broken)
+  error: SECOND/broken/bento.json: "run" is required (or "run" in "platforms" for GOOS)
+
+pinger (FIRST/pinger)
+  name: Ping
+  version: 1.2.3
+  description: Answers every sentence.
+  author: Bob
+  shadowed: SECOND/pinger
+  sentences:
+    ping ?
+      Says pong.
+
+plain (SECOND/plain)
+  sentences:
+    ping ?
+`, strings.NewReplacer(first, "FIRST", second, "SECOND",
+		"for "+runtime.GOOS, "for GOOS").Replace(out.String()))
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The types that can be used in the signature of a backend sentence. The name
+// of a backend can also be used for a variable of that backend.
+const (
+	// SentenceArgAny is used when the type is not provided. The value is
+	// always sent as text.
+	SentenceArgAny    = "any"
+	SentenceArgText   = VariableTypeText
+	SentenceArgNumber = VariableTypeNumber
+
+	// SentenceArgSelf is the backend variable that the sentence is sent to.
+	SentenceArgSelf = "self"
+)
+
+// BackendSentence is a sentence that a backend provides. It can be only the
+// sentence, or an object that also has the types of the arguments:
+//
+//	"add ? to ?"
+//	{"sentence": "add ? to ?", "args": ["number", "self"]}
+//
+// Returns are the types of the arguments that the backend will set. The keys
+// are the same as in "set" ("$0" is the first argument), but the "$" is
+// optional.
+//
+// Timeout is the number of seconds to wait for each message from the backend
+// while it handles the sentence. It replaces the "request_timeout" of the
+// backend.
+type BackendSentence struct {
+	Sentence string            `json:"sentence"`
+	Args     []string          `json:"args"`
+	Returns  map[string]string `json:"returns"`
+	Timeout  float64           `json:"timeout"`
+}
+
+func (sentence *BackendSentence) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &sentence.Sentence)
+	}
+
+	// The alias is needed so that this function is not called recursively.
+	type backendSentence BackendSentence
+
+	return json.Unmarshal(data, (*backendSentence)(sentence))
+}
+
+func (sentence *BackendSentence) String() string {
+	return sentence.Sentence
+}
+
+// Signature includes the types, if there are any. Such as
+// "add ? to ? (number, self)".
+func (sentence *BackendSentence) Signature() string {
+	if len(sentence.Args) == 0 {
+		return sentence.Sentence
+	}
+
+	return fmt.Sprintf("%s (%s)", sentence.Sentence,
+		strings.Join(sentence.Args, ", "))
+}
+
+// validate checks that the types are known and match the placeholders.
+func (sentence *BackendSentence) validate() error {
+	placeholders := strings.Count(sentence.Sentence, "?")
+
+	if sentence.Sentence == "" {
+		return fmt.Errorf("sentence must not be empty")
+	}
+
+	if len(sentence.Args) > 0 && len(sentence.Args) != placeholders {
+		return fmt.Errorf(`"%s" has %d placeholders, but %d args`,
+			sentence.Sentence, placeholders, len(sentence.Args))
+	}
+
+	for _, argType := range sentence.Args {
+		switch {
+		case argType == SentenceArgAny, argType == SentenceArgText,
+			argType == SentenceArgNumber, argType == SentenceArgSelf:
+
+		// The name of another backend is a handle to a variable of that
+		// backend.
+		case isBackendType(argType):
+
+		default:
+			return fmt.Errorf(`"%s" has unknown arg type "%s"`,
+				sentence.Sentence, argType)
+		}
+	}
+
+	if sentence.Timeout < 0 {
+		return fmt.Errorf(`"%s" has a negative timeout`, sentence.Sentence)
+	}
+
+	for key, returnType := range sentence.Returns {
+		index, ok := sentence.returnIndex(key)
+		if !ok || index >= placeholders {
+			return fmt.Errorf(`"%s" cannot return "%s"`, sentence.Sentence,
+				key)
+		}
+
+		switch returnType {
+		case SentenceArgText, SentenceArgNumber:
+		default:
+			return fmt.Errorf(`"%s" has unknown return type "%s"`,
+				sentence.Sentence, returnType)
+		}
+	}
+
+	return nil
+}
+
+func (sentence *BackendSentence) returnIndex(key string) (int, bool) {
+	index, err := strconv.Atoi(strings.TrimPrefix(key, "$"))
+
+	return index, err == nil && index >= 0
+}
+
+// argType is SentenceArgAny for untyped sentences.
+func (sentence *BackendSentence) argType(i int) string {
+	if i < len(sentence.Args) {
+		return sentence.Args[i]
+	}
+
+	return SentenceArgAny
+}
+
+// returnType is empty if the argument is not returned, or the type is not
+// known.
+func (sentence *BackendSentence) returnType(i int) string {
+	for key, returnType := range sentence.Returns {
+		if index, ok := sentence.returnIndex(key); ok && index == i {
+			return returnType
+		}
+	}
+
+	return ""
+}
+
+// argTypeError is the same at compile time and at runtime.
+func argTypeError(sentence string, i int, expected, actual string) error {
+	return fmt.Errorf(`argument %d of "%s" must be %s, but got %s`, i+1,
+		sentence, expected, actual)
+}
+
+// findBackendSentence returns nil if the sentence does not exist.
+func findBackendSentence(sentences []*BackendSentence, syntax string) *BackendSentence {
+	for _, sentence := range sentences {
+		if sentence.Sentence == syntax {
+			return sentence
+		}
+	}
+
+	return nil
+}
+
+// findSentenceProvider returns the name of the only backend that has the
+// sentence. The names must be unique. The sentences are nil for a backend that
+// has not listed its sentences, in which case the provider may not be known and
+// the result is empty without an error.
+func findSentenceProvider(syntax string, names []string,
+	sentences map[string][]*BackendSentence) (string, error) {
+	var providers []string
+	known := true
+	for _, name := range names {
+		if sentences[name] == nil {
+			known = false
+		}
+
+		if findBackendSentence(sentences[name], syntax) != nil {
+			providers = append(providers, name)
+		}
+	}
+
+	switch {
+	case len(providers) == 1:
+		return providers[0], nil
+
+	case len(providers) > 1:
+		return "", fmt.Errorf(`sentence "%s" is ambiguous because it is `+
+			`provided by backends %s`, syntax, joinNames(providers))
+
+	case !known || len(names) == 0:
+		return "", nil
+
+	case len(names) == 1:
+		return "", fmt.Errorf(`backend %s does not have sentence "%s"`,
+			names[0], syntax)
+	}
+
+	return "", fmt.Errorf(`none of the backends %s have sentence "%s"`,
+		joinNames(names), syntax)
+}
+
+// joinNames returns "a", "a and b", "a, b and c", etc.
+func joinNames(names []string) string {
+	if len(names) == 1 {
+		return names[0]
+	}
+
+	return strings.Join(names[:len(names)-1], ", ") + " and " +
+		names[len(names)-1]
+}
+
+// validateBackendSentences is used for the sentences in the bento.json and the
+// sentences returned by the backend.
+func validateBackendSentences(sentences []*BackendSentence) error {
+	for _, sentence := range sentences {
+		if err := sentence.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
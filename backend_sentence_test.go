@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+var backendSentenceTests = map[string]struct {
+	json     string
+	expected *BackendSentence
+	err      string
+}{
+	"Text": {
+		json:     `"add ? to ?"`,
+		expected: &BackendSentence{Sentence: "add ? to ?"},
+	},
+	"Object": {
+		json: `{"sentence": "add ? to ?", "args": ["number", "self"], ` +
+			`"returns": {"1": "number"}}`,
+		expected: &BackendSentence{
+			Sentence: "add ? to ?",
+			Args:     []string{"number", "self"},
+			Returns:  map[string]string{"1": "number"},
+		},
+	},
+	"DollarReturn": {
+		json: `{"sentence": "average of ? into ?", ` +
+			`"returns": {"$1": "text"}}`,
+		expected: &BackendSentence{
+			Sentence: "average of ? into ?",
+			Returns:  map[string]string{"$1": "text"},
+		},
+	},
+	"Timeout": {
+		json:     `{"sentence": "export", "timeout": 900}`,
+		expected: &BackendSentence{Sentence: "export", Timeout: 900},
+	},
+	"NegativeTimeout": {
+		json: `{"sentence": "export", "timeout": -1}`,
+		err:  `"export" has a negative timeout`,
+	},
+	"Empty": {
+		json: `""`,
+		err:  "sentence must not be empty",
+	},
+	"WrongNumberOfArgs": {
+		json: `{"sentence": "add ? to ?", "args": ["number"]}`,
+		err:  `"add ? to ?" has 2 placeholders, but 1 args`,
+	},
+	"UnknownArgType": {
+		json: `{"sentence": "add ? to ?", "args": ["number", "csv"]}`,
+		err:  `"add ? to ?" has unknown arg type "csv"`,
+	},
+	"UnknownReturn": {
+		json: `{"sentence": "add ? to ?", "returns": {"$2": "number"}}`,
+		err:  `"add ? to ?" cannot return "$2"`,
+	},
+	"UnknownReturnType": {
+		json: `{"sentence": "add ? to ?", "returns": {"$0": "self"}}`,
+		err:  `"add ? to ?" has unknown return type "self"`,
+	},
+}
+
+func TestBackendSentence(t *testing.T) {
+	for testName, test := range backendSentenceTests {
+		t.Run(testName, func(t *testing.T) {
+			var sentence *BackendSentence
+			require.NoError(t, json.Unmarshal([]byte(test.json), &sentence))
+
+			err := sentence.validate()
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, test.expected, sentence)
+			}
+		})
+	}
+}
+
+func TestBackendSentence_Signature(t *testing.T) {
+	assert.Equal(t, "add ? to ?",
+		(&BackendSentence{Sentence: "add ? to ?"}).Signature())
+	assert.Equal(t, "add ? to ? (number, self)", (&BackendSentence{
+		Sentence: "add ? to ?",
+		Args:     []string{"number", "self"},
+	}).Signature())
+}
+
+func TestFindSentenceProvider_Unknown(t *testing.T) {
+	// It cannot be known if "b" also has the sentence.
+	name, err := findSentenceProvider("find ?", []string{"a", "b"},
+		map[string][]*BackendSentence{"a": {}})
+	require.NoError(t, err)
+	assert.Equal(t, "", name)
+
+	name, err = findSentenceProvider("find ?", []string{"a", "b"},
+		map[string][]*BackendSentence{"b": {{Sentence: "find ?"}}})
+	require.NoError(t, err)
+	assert.Equal(t, "b", name)
+}
@@ -0,0 +1,1129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var backendResponseTests = map[string]struct {
+	json     string
+	failed   bool
+	expected *BackendError
+}{
+	"NoError": {
+		json: `{"text": "ok"}`,
+	},
+	"EmptyError": {
+		json:     `{"error": ""}`,
+		expected: &BackendError{},
+	},
+	"Message": {
+		json:     `{"error": "customer not found"}`,
+		failed:   true,
+		expected: &BackendError{Message: "customer not found"},
+	},
+	"Object": {
+		json: `{"error": {"message": "database is down", "code": "db", ` +
+			`"retryable": true, "details": {"host": "db1"}}}`,
+		failed: true,
+		expected: &BackendError{
+			Message:   "database is down",
+			Code:      "db",
+			Retryable: true,
+			Details:   json.RawMessage(`{"host": "db1"}`),
+		},
+	},
+	"OnlyCode": {
+		json:     `{"error": {"code": "not-found"}}`,
+		failed:   true,
+		expected: &BackendError{Code: "not-found"},
+	},
+}
+
+func TestBackendResponse_Error(t *testing.T) {
+	for testName, test := range backendResponseTests {
+		t.Run(testName, func(t *testing.T) {
+			var response *BackendResponse
+			require.NoError(t, json.Unmarshal([]byte(test.json), &response))
+
+			assert.Equal(t, test.expected, response.Error)
+			assert.Equal(t, test.failed, response.failed())
+		})
+	}
+}
+
+// newTestBackend returns a backend that is already connected. Each request
+// receives the next response.
+func newTestBackend(name string, responses ...string) *Backend {
+	return newRecordingTestBackend(name, nil, responses...)
+}
+
+// newRecordingTestBackend is the same as newTestBackend, but it also appends
+// each request to requests (if it is not nil).
+func newRecordingTestBackend(name string, requests *[]string, responses ...string) *Backend {
+	client, server := net.Pipe()
+
+	go func() {
+		reader := bufio.NewReader(server)
+		for _, response := range responses {
+			request, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			if requests != nil {
+				*requests = append(*requests, strings.TrimSpace(request))
+			}
+
+			_, _ = fmt.Fprintln(server, response)
+		}
+	}()
+
+	return &Backend{Name: name, Conn: client}
+}
+
+// newTestInstance is an instance of a backend that does not support instances.
+func newTestInstance(backend *Backend) *BackendInstance {
+	return &BackendInstance{Name: backend.Name, backend: backend}
+}
+
+func TestVirtualMachine_BackendError(t *testing.T) {
+	backend := newTestBackend("customers",
+		`{"error": {"message": "customer not found", "code": "not-found"}}`,
+		`{"error": {"message": "database is down", "retryable": true}}`,
+		`{"error": "no"}`)
+	backend.Sentences = []*BackendSentence{{Sentence: "find customer ?"}}
+
+	program := &CompiledProgram{
+		// error, error-sentence, error-backend and error-code
+		Variables: []interface{}{
+			NewText(""), NewText(""), NewText(""), NewText(""),
+		},
+		Functions: map[string]*CompiledFunction{
+			"start": {
+				Variables: []interface{}{
+					nil, NewText("find customer ?"), NewText("retryable"),
+				},
+				Instructions: []Instruction{
+					&TryInstruction{
+						Try: &CallInstruction{
+							Call: "find customer ?",
+							Args: []int{0},
+						},
+						OnFailure: &CallInstruction{
+							Call: "display ? ? ? ?",
+							Args: []int{-2, -3, -4, -5},
+						},
+						Error:         -2,
+						ErrorSentence: -3,
+						ErrorBackend:  -4,
+						ErrorCode:     -5,
+					},
+					&TryInstruction{
+						Try: &CallInstruction{
+							Call: "find customer ?",
+							Args: []int{0},
+						},
+						OnFailure: &CallInstruction{
+							Call: "failure is retryable",
+						},
+						Error:         -2,
+						ErrorSentence: -3,
+						ErrorBackend:  -4,
+						ErrorCode:     -5,
+					},
+					&QuestionJumpInstruction{True: 1, False: 2},
+					&CallInstruction{
+						Call: "display ?",
+						Args: []int{2},
+					},
+					&CallInstruction{
+						Call: "find customer ?",
+						Args: []int{0},
+					},
+				},
+			},
+		},
+	}
+
+	vm := NewVirtualMachine(program)
+	vm.out = bytes.NewBuffer(nil)
+	err := vm.Run(newTestInstance(backend))
+
+	assert.Equal(t, "customer not found"+"find customer ?"+"customers"+
+		"not-found\n"+"retryable\n", vm.out.(*bytes.Buffer).String())
+	assert.EqualError(t, err, "no")
+	assert.Equal(t, ExitBackendError, ExitCode(err))
+}
+
+func TestVirtualMachine_DisplayBackendInstance(t *testing.T) {
+	backend := newTestBackend("scores",
+		`{"text": "3 scores"}`, `{"error": "no scores"}`, `null`)
+	instance := newTestInstance(backend)
+
+	vm := NewVirtualMachine(nil)
+	vm.out = bytes.NewBuffer(nil)
+	vm.memory = []interface{}{instance}
+	vm.stackOffset = []int{0, len(vm.memory)}
+
+	require.NoError(t, display(vm, []int{0}))
+	assert.EqualError(t, display(vm, []int{0}), "no scores")
+	assert.EqualError(t, display(vm, []int{0}),
+		"backend scores sent an invalid response: null")
+	assert.Equal(t, "3 scores\n", vm.out.(*bytes.Buffer).String())
+}
+
+func TestVirtualMachine_TypedBackendSentence(t *testing.T) {
+	var requests []string
+	backend := newRecordingTestBackend("scores", &requests,
+		`{}`, `{}`, `{"set": {"$1": "abc"}}`)
+	backend.Sentences = []*BackendSentence{
+		{Sentence: "add ? to ?", Args: []string{"number", "self"}},
+		{Sentence: "rename ? to ?", Args: []string{"self", "text"}},
+		{Sentence: "tag ? with ?"},
+		{
+			Sentence: "average of ? into ?",
+			Returns:  map[string]string{"$1": "number"},
+		},
+	}
+
+	instance := newTestInstance(backend)
+
+	vm := NewVirtualMachine(nil)
+	vm.memory = []interface{}{instance, NewNumber("1.50", 2), NewText("x y")}
+	vm.stackOffset = []int{0, len(vm.memory)}
+
+	run := func(call string, args ...int) error {
+		return vm.callBackend(instance, &CallInstruction{Call: call, Args: args})
+	}
+
+	require.NoError(t, run("add ? to ?", 1, 0))
+	require.NoError(t, run("tag ? with ?", 0, 2))
+	assert.EqualError(t, run("rename ? to ?", 0, 1),
+		`argument 2 of "rename ? to ?" must be text, but got number`)
+	assert.EqualError(t, run("average of ? into ?", 0, 1),
+		`cannot set "$1": "abc" is not a number`)
+
+	assert.Equal(t, []string{
+		`{"sentence":"add ? to ?","args":[1.5,"scores"]}`,
+		`{"sentence":"tag ? with ?","args":["scores","x y"]}`,
+		`{"sentence":"average of ? into ?","args":["scores","1.5"]}`,
+	}, requests)
+}
+
+func TestVirtualMachine_FindBackendForSentence(t *testing.T) {
+	newBackend := func(name string, sentences ...string) *BackendInstance {
+		backend := NewBackend(name)
+		backend.Sentences = []*BackendSentence{}
+		for _, sentence := range sentences {
+			backend.Sentences = append(backend.Sentences,
+				&BackendSentence{Sentence: sentence})
+		}
+
+		return newTestInstance(backend)
+	}
+
+	customers := newBackend("customers", "copy ? to ?", "find ? in ?")
+	orders := newBackend("orders", "copy ? to ?", "add ? to ?")
+	otherOrders := newBackend("orders", "copy ? to ?", "add ? to ?")
+
+	vm := NewVirtualMachine(nil)
+	vm.memory = []interface{}{customers, orders, otherOrders, NewText("x")}
+	vm.stackOffset = []int{0, len(vm.memory)}
+
+	for testName, test := range map[string]struct {
+		syntax   string
+		args     []int
+		expected *BackendInstance
+		err      string
+	}{
+		"NoBackends": {
+			syntax: "find ? in ?",
+			args:   []int{3, 3},
+		},
+		"OnlyBackend": {
+			syntax:   "find ? in ?",
+			args:     []int{3, 0},
+			expected: customers,
+		},
+		"OtherBackendIsAHandle": {
+			syntax:   "add ? to ?",
+			args:     []int{0, 1},
+			expected: orders,
+		},
+		"SameBackendIsAHandle": {
+			syntax:   "add ? to ?",
+			args:     []int{2, 1},
+			expected: otherOrders,
+		},
+		"Missing": {
+			syntax: "remove ? from ?",
+			args:   []int{3, 0},
+			err:    `backend customers does not have sentence "remove ? from ?"`,
+		},
+		"MissingFromAll": {
+			syntax: "remove ? from ?",
+			args:   []int{1, 0},
+			err: `none of the backends orders and customers have ` +
+				`sentence "remove ? from ?"`,
+		},
+		"Ambiguous": {
+			syntax: "copy ? to ?",
+			args:   []int{0, 1},
+			err: `sentence "copy ? to ?" is ambiguous because it is ` +
+				`provided by backends customers and orders`,
+		},
+	} {
+		t.Run(testName, func(t *testing.T) {
+			backend, err := vm.findBackendForSentence(test.syntax, test.args)
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+			} else {
+				require.NoError(t, err)
+				assert.True(t, test.expected == backend)
+			}
+		})
+	}
+}
+
+var backendSetTests = map[string]struct {
+	set      string
+	literals []int
+	expected []interface{}
+	err      string
+}{
+	"Text": {
+		set: `{"$2": "hello"}`,
+		expected: []interface{}{
+			nil, NewNumber("0", 2), NewText("hello"), NewNumber("1", 0),
+		},
+	},
+	"Number": {
+		set: `{"$1": 12.5}`,
+		expected: []interface{}{
+			nil, NewNumber("12.5", 2), NewText(""), NewNumber("1", 0),
+		},
+	},
+	"NumberFromText": {
+		set: `{"$1": "12.25"}`,
+		expected: []interface{}{
+			nil, NewNumber("12.25", 2), NewText(""), NewNumber("1", 0),
+		},
+	},
+	"NumberIntoText": {
+		set: `{"$2": 1.50}`,
+		expected: []interface{}{
+			nil, NewNumber("0", 2), NewText("1.50"), NewNumber("1", 0),
+		},
+	},
+	"Several": {
+		set: `{"$1": 3, "$2": "three"}`,
+		expected: []interface{}{
+			nil, NewNumber("3", 2), NewText("three"), NewNumber("1", 0),
+		},
+	},
+	"TooManyDecimalPlaces": {
+		set: `{"$1": 1.125}`,
+		err: `cannot set "$1": 1.125 has more than 2 decimal places`,
+	},
+	"NotANumber": {
+		set: `{"$1": "lots"}`,
+		err: `cannot set "$1": "lots" is not a number`,
+	},
+	"Literal": {
+		set:      `{"$3": 5}`,
+		literals: []int{3},
+		err:      `cannot set "$3": it is not a variable`,
+	},
+	"Backend": {
+		set: `{"$0": "x"}`,
+		err: `cannot set "$0": cannot set scores from text`,
+	},
+	"OutOfRange": {
+		set: `{"$4": "x"}`,
+		err: `cannot set "$4": there are only 4 arguments`,
+	},
+	"InvalidKey": {
+		set: `{"2": "x"}`,
+		err: `cannot set "2": must be "$" followed by the position of the ` +
+			`argument, such as "$0"`,
+	},
+	"InvalidValue": {
+		set: `{"$2": true}`,
+		err: `value must be text or a number, but got true`,
+	},
+}
+
+func TestVirtualMachine_BackendSet(t *testing.T) {
+	for testName, test := range backendSetTests {
+		t.Run(testName, func(t *testing.T) {
+			backend := newTestInstance(
+				newTestBackend("scores", `{"set": `+test.set+`}`))
+
+			// The arguments are in a different order to the memory, so that
+			// "$n" is always the position in the sentence.
+			vm := NewVirtualMachine(nil)
+			vm.memory = []interface{}{
+				NewNumber("1", 0), NewText(""), NewNumber("0", 2), backend,
+			}
+			vm.stackOffset = []int{0, len(vm.memory)}
+
+			err := vm.callBackend(backend, &CallInstruction{
+				Call:     "update ? ? ? ?",
+				Args:     []int{3, 2, 1, 0},
+				Literals: test.literals,
+			})
+
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+			} else {
+				require.NoError(t, err)
+				test.expected[0] = backend
+				assert.Equal(t, test.expected, []interface{}{
+					vm.memory[3], vm.memory[2], vm.memory[1], vm.memory[0],
+				})
+			}
+		})
+	}
+}
+
+// callbackProgram has sentences that a backend can call back into.
+func callbackProgram() *CompiledProgram {
+	return &CompiledProgram{
+		Functions: map[string]*CompiledFunction{
+			"start": {
+				Variables: []interface{}{nil},
+				Instructions: []Instruction{
+					&CallInstruction{Call: "import ?", Args: []int{0}},
+				},
+			},
+			"greet ?": {
+				Variables: []interface{}{NewText(""), NewText("Hello ")},
+				Instructions: []Instruction{
+					&CallInstruction{Call: "display ? ?", Args: []int{1, 0}},
+				},
+			},
+			"? is big": {
+				Variables: []interface{}{NewNumber("0", 0)},
+				Instructions: []Instruction{
+					&QuestionAnswerInstruction{Yes: true},
+				},
+			},
+			"double ?": {
+				Variables: []interface{}{NewNumber("0", 0)},
+				Instructions: []Instruction{
+					&CallInstruction{Call: "add ? and ? into ?",
+						Args: []int{0, 0, 0}},
+				},
+			},
+			"quit": {
+				Variables: []interface{}{NewText("bye")},
+				Instructions: []Instruction{
+					&CallInstruction{Call: "stop with message ?", Args: []int{0}},
+				},
+			},
+		},
+	}
+}
+
+func TestVirtualMachine_BackendCallback(t *testing.T) {
+	t.Run("Sentences", func(t *testing.T) {
+		var requests []string
+		backend := newRecordingTestBackend("customers", &requests,
+			`{"callback": "greet ?", "args": ["Bob"]}`,
+			`{"callback": "? is big", "args": [12]}`,
+			`{"callback": "? is big", "args": ["abc"]}`,
+			`{"callback": "greet ?"}`,
+			`{"callback": "nope"}`,
+			`{"callback": "display ? ?", "args": ["a", 1.50]}`,
+			`{"callback": "double ?", "args": [1]}`,
+			`{"text": "done"}`)
+		backend.Sentences = []*BackendSentence{{Sentence: "import ?"}}
+
+		vm := NewVirtualMachine(callbackProgram())
+		vm.out = bytes.NewBuffer(nil)
+		require.NoError(t, vm.Run(newTestInstance(backend)))
+
+		assert.Equal(t, "Hello Bob\na1.50\n", vm.out.(*bytes.Buffer).String())
+		assert.Equal(t, []string{
+			`{"sentence":"import ?","args":["customers"]}`,
+			`{"answer":false,"set":{"$0":"Bob"}}`,
+			`{"answer":true,"set":{"$0":12}}`,
+			`{"answer":false,"error":"argument 1 of \"? is big\" must be ` +
+				`number, but got \"abc\""}`,
+			`{"answer":false,"error":"\"greet ?\" needs 1 arguments, but ` +
+				`got 0"}`,
+			`{"answer":false,"error":"no such sentence: nope"}`,
+			`{"answer":false,"set":{"$0":"a","$1":"1.50"}}`,
+			`{"answer":false,"set":{"$0":2}}`,
+		}, requests)
+	})
+
+	t.Run("Inbuilt", func(t *testing.T) {
+		var requests []string
+		backend := newRecordingTestBackend("customers", &requests,
+			`{"callback": "confirm ?", "args": ["Import all?"]}`,
+			`{"callback": "file ? exists", "args": ["no-such-file"]}`,
+			`{"callback": "ask ? into ?", "args": ["Name?", ""]}`,
+			`{"callback": "choose one of ? ? into ?", "args": ["a", "b", ""]}`,
+			`{"callback": "display ? ? ? ? ? ? ? ? ? ? ? ? ? ? ? ? ? ? ? ? ?"}`,
+			`{"callback": "set ? to ?", "args": ["a", "b"]}`,
+			`{"text": "done"}`)
+		backend.Sentences = []*BackendSentence{{Sentence: "import ?"}}
+
+		vm := NewVirtualMachine(callbackProgram())
+		vm.out = bytes.NewBuffer(nil)
+		vm.in = strings.NewReader("yes\nBob\n2\n")
+		require.NoError(t, vm.Run(newTestInstance(backend)))
+
+		assert.Equal(t, []string{
+			`{"sentence":"import ?","args":["customers"]}`,
+			`{"answer":true,"set":{"$0":"Import all?"}}`,
+			`{"answer":false,"set":{"$0":"no-such-file"}}`,
+			`{"answer":false,"set":{"$0":"Name?","$1":"Bob"}}`,
+			`{"answer":false,"set":{"$0":"a","$1":"b","$2":"b"}}`,
+			`{"answer":false,"error":"no such sentence: display ? ? ? ? ? ? ` +
+				`? ? ? ? ? ? ? ? ? ? ? ? ? ? ?"}`,
+			`{"answer":false,"error":"no such sentence: set ? to ?"}`,
+		}, requests)
+	})
+
+	t.Run("Stop", func(t *testing.T) {
+		var requests []string
+		backend := newRecordingTestBackend("customers", &requests,
+			`{"callback": "quit"}`, `{"text": "done"}`)
+		backend.Sentences = []*BackendSentence{{Sentence: "import ?"}}
+
+		vm := NewVirtualMachine(callbackProgram())
+		err := vm.Run(newTestInstance(backend))
+
+		assert.Equal(t, &StopError{Message: "bye"}, err)
+		assert.Equal(t, `{"answer":false,"error":"the program is stopping"}`,
+			requests[1])
+	})
+
+	t.Run("SameBackend", func(t *testing.T) {
+		backend := newTestBackend("customers",
+			`{"callback": "display"}`, `{"text": "done"}`)
+
+		var callbackErr error
+		response, err := backend.send(&BackendRequest{Sentence: "import ?"},
+			func(*BackendResponse) *BackendCallbackResult {
+				_, callbackErr = backend.send(&BackendRequest{}, nil)
+
+				return &BackendCallbackResult{}
+			})
+
+		require.NoError(t, err)
+		assert.Equal(t, "done", response.Text)
+		assert.EqualError(t, callbackErr, "backend customers cannot be used "+
+			"by a callback because it is waiting for the callback to finish")
+	})
+}
+
+func TestVirtualMachine_BackendProgress(t *testing.T) {
+	var requests []string
+	backend := newRecordingTestBackend("exporter", &requests,
+		`{"progress": 0.5, "message": "Exporting"}`+"\n"+
+			`{"output": "exported customers"}`+"\n"+
+			`{"callback": "display ?", "args": ["hello"]}`,
+		`{"progress": 1}`+"\n"+`{"text": "done"}`)
+
+	vm := NewVirtualMachine(&CompiledProgram{})
+	vm.out = bytes.NewBuffer(nil)
+	vm.stackOffset = []int{0, 0}
+	vm.terminal = true
+
+	response, err := vm.sendToBackend(backend,
+		&BackendRequest{Sentence: "export"}, vm.runCallback)
+	require.NoError(t, err)
+
+	assert.Equal(t, "done", response.Text)
+	assert.Equal(t, "\r\x1b[KExporting 50%"+
+		"\r\x1b[Kexported customers\nExporting 50%"+
+		"\r\x1b[Khello\n"+
+		"\r\x1b[K100%"+"\r\x1b[K", vm.out.(*bytes.Buffer).String())
+
+	// Only the callback is replied to.
+	assert.Equal(t, []string{
+		`{"sentence":"export","args":null}`,
+		`{"answer":false,"set":{"$0":"hello"}}`,
+	}, requests)
+}
+
+// newSilentTestBackend returns a backend that is already connected, but never
+// responds. Each line that it receives is sent to the channel, which is closed
+// when the connection is closed.
+func newSilentTestBackend(name string) (*Backend, chan string) {
+	client, server := net.Pipe()
+	lines := make(chan string, 10)
+
+	go func() {
+		reader := bufio.NewReader(server)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				close(lines)
+
+				return
+			}
+
+			lines <- strings.TrimSpace(line)
+		}
+	}()
+
+	return &Backend{Name: name, Conn: client}, lines
+}
+
+// receiveAll waits for the channel to be closed.
+func receiveAll(lines chan string) (all []string) {
+	for line := range lines {
+		all = append(all, line)
+	}
+
+	return
+}
+
+var backendRequestTimeoutTests = map[string]struct {
+	config   *BackendConfiguration
+	sentence string
+	expected time.Duration
+}{
+	"Default": {
+		expected: DefaultBackendRequestTimeout,
+	},
+	"Backend": {
+		config:   &BackendConfiguration{RequestTimeout: 1.5},
+		expected: 1500 * time.Millisecond,
+	},
+	"Sentence": {
+		config:   &BackendConfiguration{RequestTimeout: 1.5},
+		sentence: "export",
+		expected: 15 * time.Minute,
+	},
+	"SentenceWithoutTimeout": {
+		config:   &BackendConfiguration{RequestTimeout: 1.5},
+		sentence: "ping",
+		expected: 1500 * time.Millisecond,
+	},
+}
+
+func TestBackend_RequestTimeout(t *testing.T) {
+	for testName, test := range backendRequestTimeoutTests {
+		t.Run(testName, func(t *testing.T) {
+			backend := &Backend{
+				Config: test.config,
+				Sentences: []*BackendSentence{
+					{Sentence: "export", Timeout: 900},
+					{Sentence: "ping"},
+				},
+			}
+
+			assert.Equal(t, test.expected,
+				backend.requestTimeout(test.sentence))
+		})
+	}
+}
+
+func TestBackend_Timeout(t *testing.T) {
+	t.Run("Cancel", func(t *testing.T) {
+		backend, lines := newSilentTestBackend("exporter")
+		backend.Sentences = []*BackendSentence{
+			{Sentence: "export", Timeout: 0.05},
+		}
+
+		_, err := backend.send(&BackendRequest{Sentence: "export"}, nil)
+
+		assert.Equal(t, &BackendError{
+			Message: "backend exporter did not respond within 50ms, so it " +
+				"was stopped",
+			Code: "timeout",
+		}, err)
+		assert.Equal(t, []string{
+			`{"sentence":"export","args":null}`,
+			`{"special":"cancel"}`,
+		}, receiveAll(lines))
+
+		_, err = backend.send(&BackendRequest{Sentence: "export"}, nil)
+		assert.EqualError(t, err, "backend exporter is not running")
+	})
+
+	t.Run("Kill", func(t *testing.T) {
+		cleanup := setupHelperBackends(t)
+		defer cleanup()
+
+		backend := NewBackend("helper")
+		require.NoError(t, backend.Start())
+		backend.Config.RequestTimeout = 0.05
+		cmd := backend.cmd
+
+		_, err := backend.send(&BackendRequest{Sentence: "hang"}, nil)
+		assert.EqualError(t, err,
+			"backend helper did not respond within 50ms, so it was stopped")
+
+		// The process has exited (it may have been killed, or exited by
+		// itself when the connection was closed).
+		assert.Nil(t, backend.cmd)
+		assert.NotNil(t, cmd.ProcessState)
+		require.NoError(t, backend.Close())
+	})
+
+	t.Run("Interrupted", func(t *testing.T) {
+		backend, lines := newSilentTestBackend("exporter")
+
+		result := make(chan error)
+		go func() {
+			_, err := backend.send(&BackendRequest{Sentence: "export"}, nil)
+			result <- err
+		}()
+
+		assert.Equal(t, `{"sentence":"export","args":null}`, <-lines)
+		require.NoError(t, backend.Close())
+
+		assert.Error(t, <-result)
+		assert.Equal(t, []string{
+			`{"special":"cancel"}`,
+			`{"special":"shutdown"}`,
+		}, receiveAll(lines))
+	})
+}
+
+// TestBackendHelperProcess is not a real test. It is run as a backend by the
+// tests below, which is the only time that there will be a "--" argument
+// followed by the mode.
+func TestBackendHelperProcess(t *testing.T) {
+	if len(os.Args) < 2 || os.Args[len(os.Args)-2] != "--" {
+		return
+	}
+
+	mode := os.Args[len(os.Args)-1]
+	var conn io.ReadWriter
+
+	switch mode {
+	case "exit":
+		_, _ = fmt.Fprintln(os.Stderr, "cannot connect to database")
+		os.Exit(3)
+
+	case "never-ready":
+		time.Sleep(time.Hour)
+
+	case "stdio":
+		conn = struct {
+			io.Reader
+			io.Writer
+		}{os.Stdin, os.Stdout}
+
+	default:
+		network, address := "tcp", "127.0.0.1:"+os.Getenv("BENTO_PORT")
+		if mode == "unix" {
+			network, address = "unix", os.Getenv("BENTO_SOCKET")
+		}
+
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			os.Exit(1)
+		}
+
+		conn, err = listener.Accept()
+		if err != nil {
+			os.Exit(1)
+		}
+	}
+
+	// Instances are numbered from 1. Displaying an instance also shows how
+	// many have not been destroyed.
+	instances, live := 0, 0
+
+	reader := bufio.NewReader(conn)
+	for {
+		var request struct {
+			Special  string
+			Sentence string
+			Args     []interface{}
+		}
+
+		line, err := reader.ReadString('\n')
+		if err == nil {
+			err = json.Unmarshal([]byte(line), &request)
+		}
+
+		if err != nil || request.Special == "shutdown" {
+			if mode == "ignore-shutdown" {
+				time.Sleep(time.Hour)
+			}
+
+			os.Exit(0)
+		}
+
+		var response interface{}
+		switch {
+		case request.Special == "sentences":
+			response = map[string][]string{"sentences": {"ping ?"}}
+
+		case request.Special == "new":
+			instances++
+			live++
+			response = map[string]string{
+				"id": fmt.Sprintf("instance-%d", instances),
+			}
+
+		case request.Special == "destroy":
+			live--
+			response = map[string]string{}
+
+		case request.Sentence == "hang":
+			continue
+
+		case request.Sentence == "display ?":
+			response = map[string]string{
+				"text": fmt.Sprintf("%v of %d", request.Args[0], live),
+			}
+
+		default:
+			response = map[string]string{"text": "pong"}
+		}
+
+		data, _ := json.Marshal(response)
+		_, _ = fmt.Fprintln(conn, string(data))
+	}
+}
+
+// setupHelperBackends creates backends that all run TestBackendHelperProcess,
+// using the mode of the same name:
+//
+//	helper: A normal backend.
+//	helper-ignore-shutdown: Must be killed to shut down.
+//	helper-exit: Exits immediately with an error on stderr.
+//	helper-never-ready: Never starts listening.
+//	helper-stdio: A normal backend that uses the stdio transport.
+//	helper-unix: A normal backend that uses the unix transport.
+//
+// The returned function must be called at the end of the test.
+func setupHelperBackends(t *testing.T) (cleanup func()) {
+	dir, err := ioutil.TempDir("", "bento")
+	require.NoError(t, err)
+
+	modes := []string{
+		"tcp", "ignore-shutdown", "exit", "never-ready", "stdio", "unix",
+	}
+	for _, mode := range modes {
+		name := "helper-" + mode
+		if mode == "tcp" {
+			name = "helper"
+		}
+
+		writeHelperBackend(t, dir, name, helperBackendConfig(mode))
+	}
+
+	previous := os.Getenv("BENTO_BACKEND")
+	require.NoError(t, os.Setenv("BENTO_BACKEND", dir))
+
+	return func() {
+		_ = os.Setenv("BENTO_BACKEND", previous)
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// helperBackendConfig is the bento.json for a backend that runs
+// TestBackendHelperProcess with the mode.
+func helperBackendConfig(mode string) map[string]interface{} {
+	config := map[string]interface{}{
+		"run": os.Args[0] + " -test.run=^TestBackendHelperProcess$ -- " +
+			mode,
+	}
+
+	// The other backends use the default so that they have plenty of time to
+	// start on a slow machine.
+	if mode == "never-ready" {
+		config["startup_timeout"] = 0.5
+	}
+
+	if mode == "stdio" || mode == "unix" {
+		config["transport"] = mode
+	}
+
+	return config
+}
+
+func writeHelperBackend(t *testing.T, dir, name string,
+	config map[string]interface{}) {
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, name), 0755))
+
+	data, err := json.Marshal(config)
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(filepath.Join(dir, name, "bento.json"), data, 0644)
+	require.NoError(t, err)
+}
+
+// setShutdownTimeout changes BackendShutdownTimeout. The returned function
+// must be called to restore it.
+func setShutdownTimeout(timeout time.Duration) (restore func()) {
+	previous := BackendShutdownTimeout
+	BackendShutdownTimeout = timeout
+
+	return func() {
+		BackendShutdownTimeout = previous
+	}
+}
+
+func TestBackend_Close(t *testing.T) {
+	defer setupHelperBackends(t)()
+
+	t.Run("Shutdown", func(t *testing.T) {
+		backend := NewBackend("helper")
+		require.NoError(t, backend.Start())
+		cmd := backend.cmd
+
+		require.NoError(t, backend.Close())
+		assert.True(t, cmd.ProcessState.Success())
+		assert.Nil(t, backend.Conn)
+		assert.Nil(t, backend.cmd)
+
+		// Closing again does nothing.
+		require.NoError(t, backend.Close())
+	})
+
+	t.Run("Stdio", func(t *testing.T) {
+		backend := NewBackend("helper-stdio")
+		require.NoError(t, backend.Start())
+		cmd := backend.cmd
+
+		response, err := backend.send(&BackendRequest{
+			Sentence: "ping ?",
+			Args:     []interface{}{"helper-stdio"},
+		}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "pong", response.Text)
+		assert.Equal(t, []*BackendSentence{{Sentence: "ping ?"}}, backend.Sentences)
+
+		require.NoError(t, backend.Close())
+		assert.True(t, cmd.ProcessState.Success())
+	})
+
+	t.Run("Unix", func(t *testing.T) {
+		backend := NewBackend("helper-unix")
+		require.NoError(t, backend.Start())
+		cmd := backend.cmd
+		dir := backend.transport.(*unixTransport).dir
+
+		info, err := os.Stat(dir)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+		response, err := backend.send(&BackendRequest{
+			Sentence: "ping ?",
+			Args:     []interface{}{"helper-unix"},
+		}, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "pong", response.Text)
+
+		require.NoError(t, backend.Close())
+		assert.True(t, cmd.ProcessState.Success())
+
+		_, err = os.Stat(dir)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Killed", func(t *testing.T) {
+		// The backend never exits by itself, so it is always killed no matter
+		// how short the timeout is.
+		defer setShutdownTimeout(100 * time.Millisecond)()
+
+		backend := NewBackend("helper-ignore-shutdown")
+		require.NoError(t, backend.Start())
+		cmd := backend.cmd
+
+		require.NoError(t, backend.Close())
+		assert.False(t, cmd.ProcessState.Success())
+	})
+}
+
+func TestVirtualMachine_ClosesBackends(t *testing.T) {
+	defer setupHelperBackends(t)()
+
+	parser := NewParser(strings.NewReader("start:\n" +
+		"declare b is helper\n" +
+		"ping b\n" +
+		"run system command \"exit 1\""))
+	program, err := parser.Parse()
+	require.NoError(t, err)
+
+	compiledProgram, err := NewCompiler(program).Compile()
+	require.NoError(t, err)
+
+	vm := NewVirtualMachine(compiledProgram)
+	vm.out = bytes.NewBuffer(nil)
+	err = vm.Run()
+
+	assert.EqualError(t, err, `system command "exit 1" failed with status 1`)
+
+	backend := vm.memory[0].(*BackendInstance).backend
+	assert.Nil(t, backend.Conn)
+	assert.Nil(t, backend.cmd)
+	assert.Empty(t, vm.backends)
+}
+
+func TestVirtualMachine_BackendInstances(t *testing.T) {
+	defer setupHelperBackends(t)()
+
+	parser := NewParser(strings.NewReader("start:\n" +
+		"declare a is helper\n" +
+		"declare b is helper\n" +
+		"display a\n" +
+		"display b\n" +
+		"show another\n" +
+		"show another\n" +
+		"show a\n" +
+		"display a\n" +
+		"show another:\n" +
+		"declare c is helper\n" +
+		"display c\n" +
+		"show x (x is helper):\n" +
+		"display x"))
+	program, err := parser.Parse()
+	require.NoError(t, err)
+
+	compiledProgram, err := NewCompiler(program).Compile()
+	require.NoError(t, err)
+
+	vm := NewVirtualMachine(compiledProgram)
+	vm.out = bytes.NewBuffer(nil)
+	require.NoError(t, vm.Run())
+
+	// All of the instances are in the same process. An argument is not a new
+	// instance. Each instance is only created when it is first used.
+	assert.Equal(t, "instance-1 of 1\n"+
+		"instance-2 of 2\n"+
+		"instance-3 of 3\n"+
+		"instance-4 of 3\n"+
+		"instance-1 of 2\n"+
+		"instance-1 of 2\n", vm.out.(*bytes.Buffer).String())
+}
+
+func TestVirtualMachine_StartsBackendsWhenUsed(t *testing.T) {
+	defer setupHelperBackends(t)()
+
+	parser := NewParser(strings.NewReader("start:\n" +
+		"declare a is helper-exit\n" +
+		"declare b is helper\n" +
+		"display \"started \" b\n" +
+		"try display a, on failure display error-sentence \": \" error"))
+	program, err := parser.Parse()
+	require.NoError(t, err)
+
+	compiledProgram, err := NewCompiler(program).Compile()
+	require.NoError(t, err)
+
+	vm := NewVirtualMachine(compiledProgram)
+	vm.out = bytes.NewBuffer(nil)
+	require.NoError(t, vm.Run())
+
+	// The helper-exit backend cannot start, but that is not a failure until a
+	// is used.
+	assert.Equal(t, "started instance-1 of 1\n"+
+		"display ?: backend helper-exit did not start: exited with exit "+
+		"status 3\ncannot connect to database\n", vm.out.(*bytes.Buffer).String())
+}
+
+func TestVirtualMachine_StartsBackendsInParallel(t *testing.T) {
+	defer setupHelperBackends(t)()
+
+	vm := NewVirtualMachine(nil)
+	defer vm.Close()
+
+	instances := []*BackendInstance{
+		NewBackendInstance("helper"),
+		NewBackendInstance("helper-stdio"),
+		NewBackendInstance("helper"),
+	}
+	require.NoError(t, vm.createInstances(instances))
+
+	require.Len(t, vm.backends, 2)
+	assert.True(t, instances[0].backend == instances[2].backend)
+	assert.Equal(t, "instance-1", instances[0].ID)
+	assert.Equal(t, "instance-1", instances[1].ID)
+	assert.Equal(t, "instance-2", instances[2].ID)
+
+	err := vm.createInstances([]*BackendInstance{
+		NewBackendInstance("helper"),
+		NewBackendInstance("helper-exit"),
+	})
+	assert.EqualError(t, err, "backend helper-exit did not start: "+
+		"exited with exit status 3\ncannot connect to database")
+	assert.Len(t, vm.backends, 2)
+}
+
+func TestVirtualMachine_StartsDeclaredBackendsTogether(t *testing.T) {
+	defer setupHelperBackends(t)()
+
+	vm := NewVirtualMachine(nil)
+	defer vm.Close()
+
+	instances := newBackendInstances([]interface{}{
+		NewBackendInstance("helper"),
+		NewBackendInstance("helper-stdio"),
+		NewBackendInstance("helper"),
+	})
+	require.NoError(t, vm.createInstances(instances[:1]))
+
+	// Both backends are running, but only the instance that was used has
+	// been created.
+	assert.Len(t, vm.backends, 2)
+	assert.Equal(t, "instance-1", instances[0].ID)
+	assert.Nil(t, instances[1].backend)
+	assert.Nil(t, instances[2].backend)
+}
+
+func TestVirtualMachine_BackendStartFailsOnce(t *testing.T) {
+	defer setupHelperBackends(t)()
+	defer setShutdownTimeout(100 * time.Millisecond)()
+
+	vm := NewVirtualMachine(nil)
+	defer vm.Close()
+
+	err := vm.createInstances([]*BackendInstance{
+		NewBackendInstance("helper-never-ready"),
+	})
+	require.Error(t, err)
+
+	// The backend is not started again, so there is no need to wait for the
+	// startup timeout (500ms) again.
+	start := time.Now()
+	assert.Equal(t, err, vm.createInstances([]*BackendInstance{
+		NewBackendInstance("helper-never-ready"),
+	}))
+	assert.True(t, time.Since(start) < 250*time.Millisecond)
+}
+
+func TestBackend_Start(t *testing.T) {
+	defer setupHelperBackends(t)()
+	defer setShutdownTimeout(100 * time.Millisecond)()
+
+	t.Run("Exit", func(t *testing.T) {
+		err := NewBackend("helper-exit").Start()
+		assert.EqualError(t, err, "backend helper-exit did not start: "+
+			"exited with exit status 3\ncannot connect to database")
+	})
+
+	t.Run("NeverReady", func(t *testing.T) {
+		backend := NewBackend("helper-never-ready")
+		err := backend.Start()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "backend helper-never-ready did not "+
+			"start: not ready after 500ms: dial tcp")
+		assert.Nil(t, backend.cmd)
+	})
+}
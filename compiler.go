@@ -1,5 +1,13 @@
 package main
 
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
 type CompiledFunction struct {
 	Variables         []interface{}
 	Instructions      []Instruction
@@ -8,12 +16,28 @@ type CompiledFunction struct {
 
 type CompiledProgram struct {
 	Functions map[string]*CompiledFunction
+
+	// Variables are the file-level variables. They are shared by all
+	// functions.
+	Variables []interface{}
 }
 
 type Compiler struct {
 	program  *Program
 	function *Function
 	cf       *CompiledFunction
+
+	// Warnings do not stop the program from being compiled, but they are
+	// likely to be mistakes.
+	Warnings []string
+
+	// errors are collected so that all of them can be reported at once.
+	errors []string
+
+	// backendSentences are read from the bento.json of each backend the first
+	// time they are needed. They are nil if the backend does not list its
+	// sentences.
+	backendSentences map[string][]*BackendSentence
 }
 
 func NewCompiler(program *Program) *Compiler {
@@ -22,18 +46,68 @@ func NewCompiler(program *Program) *Compiler {
 	}
 }
 
-func (compiler *Compiler) Compile() *CompiledProgram {
+func (compiler *Compiler) Compile() (*CompiledProgram, error) {
 	cp := &CompiledProgram{
 		Functions: make(map[string]*CompiledFunction),
 	}
 
+	for _, variable := range compiler.program.Variables {
+		compiler.checkNotConstant(variable)
+		compiler.checkNotErrorVariable(variable.Name)
+		cp.Variables = append(cp.Variables, newVariableValue(variable))
+	}
+
+	// The error variables are placed after the file-level variables. See
+	// resolveErrorVariable.
+	if compiler.program.UsesTry {
+		for _, constant := range compiler.program.Constants {
+			compiler.checkNotErrorVariable(constant.Name)
+		}
+
+		for range errorVariables {
+			cp.Variables = append(cp.Variables, NewText(""))
+		}
+	}
+
 	for _, compiler.function = range compiler.program.Functions {
 		syntax := compiler.function.Definition.Syntax()
 		compiler.compileFunction()
 		cp.Functions[syntax] = compiler.cf
 	}
 
-	return cp
+	if len(compiler.errors) > 0 {
+		return nil, errors.New(strings.Join(compiler.errors, "\n"))
+	}
+
+	return cp, nil
+}
+
+func (compiler *Compiler) appendError(format string, args ...interface{}) {
+	compiler.errors = append(compiler.errors, fmt.Sprintf(format, args...))
+}
+
+// checkNotErrorVariable makes sure that the program cannot declare its own
+// variable with the same name as one of the error variables. Otherwise, the
+// sentences after "try" would read a different variable to the one that "try"
+// sets.
+func (compiler *Compiler) checkNotErrorVariable(name string) {
+	if !compiler.program.UsesTry {
+		return
+	}
+
+	for _, errorVariable := range errorVariables {
+		if name == errorVariable {
+			compiler.appendError(`cannot declare "%s" because it is set `+
+				`by try`, name)
+		}
+	}
+}
+
+func (compiler *Compiler) checkNotConstant(variable *VariableDefinition) {
+	if compiler.program.Constant(variable.Name) != nil {
+		compiler.appendError(`cannot declare variable "%s" because it is `+
+			`already defined as a constant`, variable.Name)
+	}
 }
 
 func (compiler *Compiler) compileFunction() {
@@ -42,21 +116,19 @@ func (compiler *Compiler) compileFunction() {
 	// Make spaces for the arguments and locally declared variables. These
 	// placeholders will be nil. The virtual machine will fill in the real
 	// values at the time the function is invoked.
+	fileVariables := compiler.program.VariableMap()
 	for _, variable := range compiler.function.Variables {
-		var value interface{}
-
-		switch variable.Type {
-		case VariableTypeText:
-			value = NewText("")
-
-		case VariableTypeNumber:
-			value = NewNumber("0", variable.Precision)
+		compiler.checkNotConstant(variable)
+		compiler.checkNotErrorVariable(variable.Name)
 
-		default:
-			value = NewBackend(variable.Type)
+		if _, ok := fileVariables[variable.Name]; ok {
+			compiler.Warnings = append(compiler.Warnings,
+				fmt.Sprintf(`"%s" shadows the file-level variable "%s"`,
+					compiler.function.Definition.Syntax(), variable.Name))
 		}
 
-		compiler.cf.Variables = append(compiler.cf.Variables, value)
+		compiler.cf.Variables = append(compiler.cf.Variables,
+			newVariableValue(variable))
 	}
 
 	// All of other constants are appended into the end.
@@ -78,6 +150,15 @@ func (compiler *Compiler) compileStatement(statement Statement) []Instruction {
 	case *While:
 		return compiler.compileWhile(stmt)
 
+	case *ForEach:
+		return compiler.compileForEach(stmt)
+
+	case *Try:
+		return []Instruction{compiler.compileTry(stmt)}
+
+	case *Assert:
+		return compiler.compileAssert(stmt)
+
 	case *QuestionAnswer:
 		return []Instruction{compiler.compileQuestionAnswer(stmt)}
 	}
@@ -85,6 +166,28 @@ func (compiler *Compiler) compileStatement(statement Statement) []Instruction {
 	return nil
 }
 
+// newVariableValue creates the default value for a declared variable.
+func newVariableValue(variable *VariableDefinition) interface{} {
+	switch variable.Type {
+	case VariableTypeText:
+		return NewText("")
+
+	case VariableTypeNumber:
+		return NewNumber("0", variable.Precision)
+
+	case VariableTypeCSV:
+		return NewCSVFile("")
+
+	case VariableTypeCSVRow:
+		return &CSVRow{File: NewCSVFile("")}
+
+	case VariableTypeJSON:
+		return &JSONValue{}
+	}
+
+	return NewBackendInstance(variable.Type)
+}
+
 func (compiler *Compiler) resolveArg(arg interface{}) int {
 	switch a := arg.(type) {
 	case VariableReference:
@@ -98,6 +201,25 @@ func (compiler *Compiler) resolveArg(arg interface{}) int {
 			}
 		}
 
+		for i, arg2 := range compiler.program.Variables {
+			if string(a) == arg2.Name {
+				return fileVariableIndex(i)
+			}
+		}
+
+		if index := compiler.resolveErrorVariable(string(a)); index != blackholeVariableIndex {
+			return index
+		}
+
+		// Constants are folded into the constant pool just like literals. A
+		// copy is used so that the value can never be shared between
+		// functions.
+		if constant := compiler.program.Constant(string(a)); constant != nil {
+			compiler.cf.Variables = append(compiler.cf.Variables,
+				copyValue(constant.Value))
+			return len(compiler.cf.Variables) - 1
+		}
+
 		// TODO: handle bad variable name
 
 	case *string, *Number:
@@ -109,22 +231,349 @@ func (compiler *Compiler) resolveArg(arg interface{}) int {
 	return 0
 }
 
+// isConstant will be false if a variable shadows the constant. However, that
+// is already an error.
+func (compiler *Compiler) isConstant(name VariableReference) bool {
+	for _, variable := range compiler.function.Variables {
+		if variable.Name == string(name) {
+			return false
+		}
+	}
+
+	for _, variable := range compiler.program.Variables {
+		if variable.Name == string(name) {
+			return false
+		}
+	}
+
+	return compiler.program.Constant(string(name)) != nil
+}
+
 func (compiler *Compiler) compileQuestionAnswer(answer *QuestionAnswer) Instruction {
 	return &QuestionAnswerInstruction{
 		Yes: answer.Yes,
 	}
 }
 
+// isKnownSentence is true for inbuilt sentences and functions in the program.
+func (compiler *Compiler) isKnownSentence(syntax string) bool {
+	_, isSystem := System[syntax]
+	_, isFunction := compiler.program.Functions[syntax]
+
+	return isSystem || isFunction
+}
+
+// disambiguate handles variables that have the same name as one of the words
+// in a sentence. For example, "write row ? to csv ?" when there is also a
+// variable called "row". If the sentence does not exist, it is matched against
+// each inbuilt sentence and function, where a variable can only be read as a
+// word in the same position. A sentence for a backend is never changed.
+func (compiler *Compiler) disambiguate(sentence *Sentence) *Sentence {
+	if compiler.isKnownSentence(sentence.Syntax()) {
+		return sentence
+	}
+
+	for _, arg := range sentence.Args() {
+		if isBackendType(compiler.argType(arg)) {
+			return sentence
+		}
+	}
+
+	var syntaxes []string
+	for syntax := range System {
+		syntaxes = append(syntaxes, syntax)
+	}
+	for syntax := range compiler.program.Functions {
+		syntaxes = append(syntaxes, syntax)
+	}
+	sort.Strings(syntaxes)
+
+	var matches []*Sentence
+	var matchedSyntaxes []string
+	for _, syntax := range syntaxes {
+		if match := matchSentence(sentence, syntax); match != nil {
+			matches = append(matches, match)
+			matchedSyntaxes = append(matchedSyntaxes, fmt.Sprintf("%q", syntax))
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return sentence
+
+	case 1:
+		return matches[0]
+	}
+
+	compiler.appendError(`sentence "%s" is ambiguous because it could be %s`,
+		sentence.Syntax(), strings.Join(matchedSyntaxes, " or "))
+
+	return sentence
+}
+
+// matchSentence returns the sentence with variables replaced by words so that
+// it has the syntax, or nil if that is not possible.
+func matchSentence(sentence *Sentence, syntax string) *Sentence {
+	words := strings.Split(syntax, " ")
+	if len(words) != len(sentence.Words) {
+		return nil
+	}
+
+	match := &Sentence{Words: append([]interface{}{}, sentence.Words...)}
+	for i, word := range words {
+		actual := sentence.Words[i]
+		_, isWord := actual.(string)
+
+		switch {
+		case word == "?" && !isWord, actual == word:
+
+		case actual == VariableReference(word):
+			match.Words[i] = word
+
+		default:
+			return nil
+		}
+	}
+
+	return match
+}
+
 func (compiler *Compiler) compileSentence(sentence *Sentence) Instruction {
+	sentence = compiler.disambiguate(sentence)
+
+	switch sentence.Syntax() {
+	case "load settings from ?", "load required settings from ?":
+		return compiler.compileLoadSettings(sentence)
+	}
+
 	instruction := &CallInstruction{
 		Call: sentence.Syntax(),
 		Args: nil,
 	}
 
-	// TODO: Check the syntax exists in the system or file.
+	isBackendSentence := !compiler.isKnownSentence(sentence.Syntax())
+	if isBackendSentence {
+		compiler.checkBackendSentence(sentence)
+	}
 
-	for _, arg := range sentence.Args() {
+	_, isFunction := compiler.program.Functions[sentence.Syntax()]
+	for i, arg := range sentence.Args() {
 		instruction.Args = append(instruction.Args, compiler.resolveArg(arg))
+
+		name, isVariable := arg.(VariableReference)
+		if (isBackendSentence || isFunction) &&
+			(!isVariable || compiler.isConstant(name)) {
+			instruction.Literals = append(instruction.Literals, i)
+		}
+	}
+
+	args := sentence.Args()
+	for _, destination := range SystemDestinations[instruction.Call] {
+		name, ok := args[destination].(VariableReference)
+		if ok && compiler.isConstant(name) {
+			compiler.appendError(`cannot change constant "%s" in "%s"`,
+				name, instruction.Call)
+		}
+	}
+
+	return instruction
+}
+
+// checkBackendSentence makes sure that a sentence sent to a backend exists,
+// is only provided by one of the backends used in the sentence, and has the
+// right types. It can only be checked if the bento.json of each backend lists
+// its sentences.
+// checkBackendSentencesKnown warns when a sentence uses several backends, but
+// it cannot be checked for ambiguity because the sentences of some of them are
+// only known when they are running.
+func (compiler *Compiler) checkBackendSentencesKnown(syntax string,
+	names []string, sentences map[string][]*BackendSentence) {
+	if len(names) < 2 {
+		return
+	}
+
+	var unknown []string
+	for _, name := range names {
+		if sentences[name] == nil {
+			unknown = append(unknown, name)
+		}
+	}
+
+	if len(unknown) > 0 {
+		compiler.Warnings = append(compiler.Warnings, fmt.Sprintf(
+			`cannot check if sentence "%s" is ambiguous until the program `+
+				`is run because the bento.json of %s does not have "sentences"`,
+			syntax, joinNames(unknown)))
+	}
+}
+
+func (compiler *Compiler) checkBackendSentence(sentence *Sentence) {
+	args := sentence.Args()
+
+	var names []string
+	sentences := map[string][]*BackendSentence{}
+	for _, arg := range args {
+		argType := compiler.argType(arg)
+		if _, ok := sentences[argType]; ok || !isBackendType(argType) {
+			continue
+		}
+
+		names = append(names, argType)
+		sentences[argType] = compiler.loadBackendSentences(argType)
+	}
+
+	syntax := sentence.Syntax()
+	compiler.checkBackendSentencesKnown(syntax, names, sentences)
+
+	backendName, err := findSentenceProvider(syntax, names, sentences)
+	if err != nil {
+		compiler.appendError("%v", err)
+
+		return
+	}
+
+	if backendName == "" {
+		return
+	}
+
+	signature := findBackendSentence(sentences[backendName], syntax)
+
+	for i, arg := range args {
+		actual := compiler.argType(arg)
+		expected := signature.argType(i)
+
+		switch expected {
+		case SentenceArgAny:
+			continue
+
+		case SentenceArgSelf:
+			if actual == backendName {
+				continue
+			}
+
+			expected = "the " + backendName + " variable"
+
+		default:
+			if actual == expected {
+				continue
+			}
+
+			if isBackendType(expected) {
+				expected = "a " + expected + " variable"
+			}
+		}
+
+		compiler.appendError("%v", argTypeError(syntax, i, expected, actual))
+	}
+
+	for i, arg := range args {
+		returnType := signature.returnType(i)
+		if returnType == "" {
+			continue
+		}
+
+		name, ok := arg.(VariableReference)
+		if !ok || compiler.isConstant(name) {
+			compiler.appendError(`argument %d of "%s" must be a variable `+
+				`because it is set by the backend`, i+1, syntax)
+
+			continue
+		}
+
+		actual := compiler.argType(arg)
+		if actual != returnType && actual != VariableTypeBlackhole {
+			compiler.appendError(`argument %d of "%s" must be a %s variable `+
+				`because it is set by the backend, but got %s`, i+1, syntax,
+				returnType, actual)
+		}
+	}
+}
+
+// loadBackendSentences returns nil if the backend cannot be found or does not
+// list its sentences. Any problem with the bento.json is reported when the
+// backend is started instead.
+func (compiler *Compiler) loadBackendSentences(name string) []*BackendSentence {
+	if name == "" {
+		return nil
+	}
+
+	if compiler.backendSentences == nil {
+		compiler.backendSentences = map[string][]*BackendSentence{}
+	}
+
+	if sentences, ok := compiler.backendSentences[name]; ok {
+		return sentences
+	}
+
+	var sentences []*BackendSentence
+	if paths := findBackendPaths(backendDirectories(), name); len(paths) > 0 {
+		config, err := readBackendConfiguration(
+			filepath.Join(paths[0], "bento.json"))
+		if err == nil {
+			sentences = config.Sentences
+		}
+	}
+
+	compiler.backendSentences[name] = sentences
+
+	return sentences
+}
+
+// argType is the type of a literal, variable or constant. It is empty if the
+// variable does not exist.
+func (compiler *Compiler) argType(arg interface{}) string {
+	switch a := arg.(type) {
+	case *string:
+		return VariableTypeText
+
+	case *Number:
+		return VariableTypeNumber
+
+	case VariableReference:
+		if a == BlackholeVariable {
+			return VariableTypeBlackhole
+		}
+
+		for _, variable := range compiler.function.Variables {
+			if string(a) == variable.Name {
+				return variable.Type
+			}
+		}
+
+		for _, variable := range compiler.program.Variables {
+			if string(a) == variable.Name {
+				return variable.Type
+			}
+		}
+
+		if compiler.resolveErrorVariable(string(a)) != blackholeVariableIndex {
+			return VariableTypeText
+		}
+
+		if constant := compiler.program.Constant(string(a)); constant != nil {
+			return constant.Type()
+		}
+	}
+
+	return ""
+}
+
+// compileLoadSettings needs to know the names of the variables so that they
+// can be matched to each of the settings. Only file-level variables can be
+// set because they are the settings for the whole program.
+func (compiler *Compiler) compileLoadSettings(sentence *Sentence) Instruction {
+	instruction := &LoadSettingsInstruction{
+		Path:      compiler.resolveArg(sentence.Args()[0]),
+		Variables: map[string]int{},
+		Required:  sentence.Syntax() == "load required settings from ?",
+	}
+
+	for _, variable := range compiler.program.Variables {
+		switch variable.Type {
+		case VariableTypeText, VariableTypeNumber:
+			instruction.Variables[variable.Name] =
+				compiler.resolveFileVariable(variable.Name)
+		}
 	}
 
 	return instruction
@@ -214,3 +663,101 @@ func (compiler *Compiler) compileWhile(whileStmt *While) []Instruction {
 
 	return instructions
 }
+
+func (compiler *Compiler) compileForEach(forEach *ForEach) []Instruction {
+	iterate := &IterateInstruction{
+		Call: forEach.Source.Syntax(),
+	}
+
+	for _, arg := range forEach.Source.Args() {
+		iterate.Args = append(iterate.Args, compiler.resolveArg(arg))
+	}
+
+	if _, ok := Iterators[iterate.Call]; !ok {
+		compiler.appendError(`cannot use "for each ? %s"`, iterate.Call)
+	}
+
+	return []Instruction{
+		iterate,
+		&NextInstruction{
+			Variable: compiler.resolveArg(forEach.Variable),
+			True:     1,
+			False:    3,
+		},
+		compiler.compileSentence(forEach.Body),
+		&JumpInstruction{Forward: -2},
+	}
+}
+
+func (compiler *Compiler) compileTry(tryStmt *Try) Instruction {
+	instruction := &TryInstruction{
+		Try:           compiler.compileSentence(tryStmt.Try),
+		Error:         compiler.resolveErrorVariable(ErrorVariable),
+		ErrorSentence: compiler.resolveErrorVariable(ErrorSentenceVariable),
+		ErrorBackend:  compiler.resolveErrorVariable(ErrorBackendVariable),
+		ErrorCode:     compiler.resolveErrorVariable(ErrorCodeVariable),
+	}
+
+	if tryStmt.OnFailure != nil {
+		instruction.OnFailure = compiler.compileSentence(tryStmt.OnFailure)
+	}
+
+	if tryStmt.Finally != nil {
+		instruction.Finally = compiler.compileSentence(tryStmt.Finally)
+	}
+
+	return instruction
+}
+
+// resolveErrorVariable returns the index of one of the error variables, which
+// come after the file-level variables. It is the blackhole if the name is not
+// an error variable, or the program does not use "try".
+func (compiler *Compiler) resolveErrorVariable(name string) int {
+	if !compiler.program.UsesTry {
+		return blackholeVariableIndex
+	}
+
+	for i, errorVariable := range errorVariables {
+		if name == errorVariable {
+			return fileVariableIndex(len(compiler.program.Variables) + i)
+		}
+	}
+
+	return blackholeVariableIndex
+}
+
+// resolveFileVariable ignores any local variables with the same name.
+func (compiler *Compiler) resolveFileVariable(name string) int {
+	for i, variable := range compiler.program.Variables {
+		if variable.Name == name {
+			return fileVariableIndex(i)
+		}
+	}
+
+	return blackholeVariableIndex
+}
+
+func (compiler *Compiler) compileAssert(assertStmt *Assert) (instructions []Instruction) {
+	failed := &AssertionFailedInstruction{}
+
+	if assertStmt.Condition != nil {
+		failed.Assertion = assertStmt.Condition.String()
+		instructions = append(instructions, &ConditionJumpInstruction{
+			True:     2,
+			False:    1,
+			Operator: assertStmt.Condition.Operator,
+			Left:     compiler.resolveArg(assertStmt.Condition.Left),
+			Right:    compiler.resolveArg(assertStmt.Condition.Right),
+		})
+	} else {
+		failed.Assertion = assertStmt.Question.String()
+		instructions = append(instructions,
+			compiler.compileSentence(assertStmt.Question),
+			&QuestionJumpInstruction{
+				True:  2,
+				False: 1,
+			})
+	}
+
+	return append(instructions, failed)
+}
@@ -4,6 +4,9 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -42,6 +45,45 @@ var compileTests = map[string]struct {
 			},
 		},
 	},
+	"BackendSentenceLiterals": {
+		program: &Program{
+			Functions: map[string]*Function{
+				"start": {
+					Definition: &Sentence{Words: []interface{}{"start"}},
+					Variables: []*VariableDefinition{
+						{
+							Name: "name",
+							Type: "text",
+						},
+					},
+					Statements: []Statement{
+						&Sentence{
+							Words: []interface{}{
+								"send", NewText("hello"), "to",
+								VariableReference("name"),
+							},
+						},
+					},
+				},
+			},
+		},
+		expected: &CompiledProgram{
+			Functions: map[string]*CompiledFunction{
+				"start": {
+					Variables: []interface{}{
+						NewText(""), NewText("hello"),
+					},
+					Instructions: []Instruction{
+						&CallInstruction{
+							Call:     "send ? to ?",
+							Args:     []int{1, 0},
+							Literals: []int{0},
+						},
+					},
+				},
+			},
+		},
+	},
 	"DisplayVariable": {
 		program: &Program{
 			Functions: map[string]*Function{
@@ -117,6 +159,236 @@ var compileTests = map[string]struct {
 			},
 		},
 	},
+	"DisplayFileVariable": {
+		program: &Program{
+			Functions: map[string]*Function{
+				"start": {
+					Definition: &Sentence{Words: []interface{}{"start"}},
+					Statements: []Statement{
+						&Sentence{
+							Words: []interface{}{
+								"display", VariableReference("name"),
+							},
+						},
+					},
+				},
+			},
+			Variables: []*VariableDefinition{
+				{
+					Name: "name",
+					Type: "text",
+				},
+			},
+		},
+		expected: &CompiledProgram{
+			Functions: map[string]*CompiledFunction{
+				"start": {
+					Instructions: []Instruction{
+						&CallInstruction{
+							Call: "display ?",
+							Args: []int{-2},
+						},
+					},
+				},
+			},
+			Variables: []interface{}{
+				NewText(""),
+			},
+		},
+	},
+	"DisplayConstant": {
+		program: &Program{
+			Functions: map[string]*Function{
+				"start": {
+					Definition: &Sentence{Words: []interface{}{"start"}},
+					Statements: []Statement{
+						&Sentence{
+							Words: []interface{}{
+								"display", VariableReference("rate"),
+							},
+						},
+					},
+				},
+			},
+			Constants: []*ConstantDefinition{
+				{
+					Name:  "rate",
+					Value: NewNumber("0.15", UnlimitedPrecision),
+				},
+			},
+		},
+		expected: &CompiledProgram{
+			Functions: map[string]*CompiledFunction{
+				"start": {
+					Variables: []interface{}{
+						NewNumber("0.15", UnlimitedPrecision),
+					},
+					Instructions: []Instruction{
+						&CallInstruction{
+							Call: "display ?",
+							Args: []int{0},
+						},
+					},
+				},
+			},
+		},
+	},
+	"ForEach": {
+		program: &Program{
+			Functions: map[string]*Function{
+				"start": {
+					Definition: &Sentence{Words: []interface{}{"start"}},
+					Variables: []*VariableDefinition{
+						{
+							Name:       "line",
+							Type:       "text",
+							LocalScope: true,
+						},
+					},
+					Statements: []Statement{
+						&ForEach{
+							Variable: VariableReference("line"),
+							Source: &Sentence{
+								Words: []interface{}{
+									"in", "file", NewText("a.txt"),
+								},
+							},
+							Body: &Sentence{
+								Words: []interface{}{
+									"display", VariableReference("line"),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		expected: &CompiledProgram{
+			Functions: map[string]*CompiledFunction{
+				"start": {
+					Variables: []interface{}{
+						NewText(""), NewText("a.txt"),
+					},
+					Instructions: []Instruction{
+						&IterateInstruction{
+							Call: "in file ?",
+							Args: []int{1},
+						},
+						&NextInstruction{
+							Variable: 0,
+							True:     1,
+							False:    3,
+						},
+						&CallInstruction{
+							Call: "display ?",
+							Args: []int{0},
+						},
+						&JumpInstruction{
+							Forward: -2,
+						},
+					},
+				},
+			},
+		},
+	},
+	"Try": {
+		program: &Program{
+			UsesTry: true,
+			Functions: map[string]*Function{
+				"start": {
+					Definition: &Sentence{Words: []interface{}{"start"}},
+					Statements: []Statement{
+						&Try{
+							Try: &Sentence{
+								Words: []interface{}{
+									"run", "system", "command", NewText("false"),
+								},
+							},
+							OnFailure: &Sentence{
+								Words: []interface{}{
+									"display", VariableReference("error"),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+		expected: &CompiledProgram{
+			Variables: []interface{}{
+				NewText(""), NewText(""), NewText(""), NewText(""),
+			},
+			Functions: map[string]*CompiledFunction{
+				"start": {
+					Variables: []interface{}{
+						NewText("false"),
+					},
+					Instructions: []Instruction{
+						&TryInstruction{
+							Try: &CallInstruction{
+								Call: "run system command ?",
+								Args: []int{0},
+							},
+							OnFailure: &CallInstruction{
+								Call: "display ?",
+								Args: []int{-2},
+							},
+							Error:         -2,
+							ErrorSentence: -3,
+							ErrorBackend:  -4,
+							ErrorCode:     -5,
+						},
+					},
+				},
+			},
+		},
+	},
+	"VariableWithSameNameAsWord": {
+		program: &Program{
+			Functions: map[string]*Function{
+				"start": {
+					Definition: &Sentence{Words: []interface{}{"start"}},
+					Variables: []*VariableDefinition{
+						{
+							Name:       "row",
+							Type:       "csv-row",
+							LocalScope: true,
+						},
+						{
+							Name:       "output",
+							Type:       "csv",
+							LocalScope: true,
+						},
+					},
+					Statements: []Statement{
+						&Sentence{
+							Words: []interface{}{
+								"write", VariableReference("row"),
+								NewText("a"), "to", "csv",
+								VariableReference("output"),
+							},
+						},
+					},
+				},
+			},
+		},
+		expected: &CompiledProgram{
+			Functions: map[string]*CompiledFunction{
+				"start": {
+					Variables: []interface{}{
+						&CSVRow{File: NewCSVFile("")}, NewCSVFile(""),
+						NewText("a"),
+					},
+					Instructions: []Instruction{
+						&CallInstruction{
+							Call: "write row ? to csv ?",
+							Args: []int{2, 1},
+						},
+					},
+				},
+			},
+		},
+	},
 	"Display2": {
 		program: &Program{
 			Functions: map[string]*Function{
@@ -253,8 +525,9 @@ var compileTests = map[string]struct {
 					},
 					Instructions: []Instruction{
 						&CallInstruction{
-							Call: "print ?",
-							Args: []int{0},
+							Call:     "print ?",
+							Args:     []int{0},
+							Literals: []int{0},
 						},
 					},
 				},
@@ -943,7 +1216,8 @@ func TestCompileProgram(t *testing.T) {
 	for testName, test := range compileTests {
 		t.Run(testName, func(t *testing.T) {
 			compiler := NewCompiler(test.program)
-			cf := compiler.Compile()
+			cf, err := compiler.Compile()
+			require.NoError(t, err)
 
 			diff := cmp.Diff(test.expected, cf,
 				cmpopts.IgnoreTypes((func([]interface{}))(nil)),
@@ -956,3 +1230,211 @@ func TestCompileProgram(t *testing.T) {
 		})
 	}
 }
+
+func TestCompiler_ShadowedFileVariable(t *testing.T) {
+	compiler := NewCompiler(&Program{
+		Functions: map[string]*Function{
+			"start": {
+				Definition: &Sentence{Words: []interface{}{"start"}},
+				Variables: []*VariableDefinition{
+					{
+						Name:       "name",
+						Type:       "text",
+						LocalScope: true,
+					},
+				},
+			},
+		},
+		Variables: []*VariableDefinition{
+			{
+				Name: "name",
+				Type: "text",
+			},
+		},
+	})
+	_, err := compiler.Compile()
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		`"start" shadows the file-level variable "name"`,
+	}, compiler.Warnings)
+}
+
+var compileErrorTests = map[string]struct {
+	bento    string
+	expected string
+}{
+	"SetConstant": {
+		bento:    "define rate as 0.15\nstart: set rate to 1.5",
+		expected: `cannot change constant "rate" in "set ? to ?"`,
+	},
+	"AddIntoConstant": {
+		bento:    "define rate as 0.15\nstart: add 1 and 2 into rate",
+		expected: `cannot change constant "rate" in "add ? and ? into ?"`,
+	},
+	"UnknownForEach": {
+		bento:    "start: declare x is text\nfor each x in nothing, display x",
+		expected: `cannot use "for each ? in nothing"`,
+	},
+	"DeclareConstant": {
+		bento: "define rate as 0.15\nstart: declare rate is number",
+		expected: `cannot declare variable "rate" because it is already ` +
+			`defined as a constant`,
+	},
+	"DeclareErrorVariable": {
+		bento: "start:\n\tdeclare error is text\n\t" +
+			"try display \"hi\", on failure display error",
+		expected: `cannot declare "error" because it is set by try`,
+	},
+	"DeclareFileLevelErrorVariable": {
+		bento: "declare error-code is text\n" +
+			"start: try display \"hi\", on failure display error-code",
+		expected: `cannot declare "error-code" because it is set by try`,
+	},
+	"AmbiguousSentence": {
+		bento: "start:\n\tdeclare hi is text\n\tdeclare now is text\n\t" +
+			"say hi now\nsay greeting now (greeting is text):\n\t" +
+			"display greeting\nsay hi greeting (greeting is text):\n\t" +
+			"display greeting",
+		expected: `sentence "say ? ?" is ambiguous because it could be ` +
+			`"say ? now" or "say hi ?"`,
+	},
+}
+
+func TestCompiler_Errors(t *testing.T) {
+	for testName, test := range compileErrorTests {
+		t.Run(testName, func(t *testing.T) {
+			parser := NewParser(strings.NewReader(test.bento))
+			program, err := parser.Parse()
+			require.NoError(t, err)
+
+			_, err = NewCompiler(program).Compile()
+			assert.EqualError(t, err, test.expected)
+		})
+	}
+}
+
+var compileBackendSentenceTests = map[string]struct {
+	statement string
+	expected  string
+}{
+	"Untyped": {
+		statement: "display scores",
+	},
+	"Typed": {
+		statement: "add 1.5 to scores",
+	},
+	"TypedVariable": {
+		statement: "add avg to scores",
+	},
+	"TypedConstant": {
+		statement: "add bonus to scores",
+	},
+	"Returns": {
+		statement: "average of scores into avg",
+	},
+	"ReturnsBlackhole": {
+		statement: "average of scores into _",
+	},
+	"UnknownSentence": {
+		statement: "remove 1.5 from scores",
+		expected:  `backend typed-scores does not have sentence "remove ? from ?"`,
+	},
+	"WrongType": {
+		statement: "add name to scores",
+		expected:  `argument 1 of "add ? to ?" must be number, but got text`,
+	},
+	"WrongLiteralType": {
+		statement: `rename scores to 123`,
+		expected:  `argument 2 of "rename ? to ?" must be text, but got number`,
+	},
+	"WrongSelf": {
+		statement: "add scores to scores",
+		expected: `argument 1 of "add ? to ?" must be number, but got ` +
+			`typed-scores`,
+	},
+	"ReturnsLiteral": {
+		statement: "average of scores into 1.5",
+		expected: `argument 2 of "average of ? into ?" must be a variable ` +
+			`because it is set by the backend`,
+	},
+	"ReturnsConstant": {
+		statement: "average of scores into bonus",
+		expected: `argument 2 of "average of ? into ?" must be a variable ` +
+			`because it is set by the backend`,
+	},
+	"ReturnsWrongType": {
+		statement: "average of scores into name",
+		expected: `argument 2 of "average of ? into ?" must be a number ` +
+			`variable because it is set by the backend, but got text`,
+	},
+	"Handle": {
+		statement: "import customers from scores",
+	},
+	"WrongHandle": {
+		statement: "import customers from customers",
+		expected: `argument 2 of "import ? from ?" must be a typed-scores ` +
+			`variable, but got typed-customers`,
+	},
+	"Ambiguous": {
+		statement: "copy customers to scores",
+		expected: `sentence "copy ? to ?" is ambiguous because it is ` +
+			`provided by backends typed-customers and typed-scores`,
+	},
+	"MissingFromAll": {
+		statement: "merge customers into scores",
+		expected: `none of the backends typed-customers and typed-scores ` +
+			`have sentence "merge ? into ?"`,
+	},
+}
+
+func TestCompiler_BackendSentences(t *testing.T) {
+	previous := os.Getenv("BENTO_BACKEND")
+	defer os.Setenv("BENTO_BACKEND", previous)
+	require.NoError(t, os.Setenv("BENTO_BACKEND", "tests/backends"))
+
+	for testName, test := range compileBackendSentenceTests {
+		t.Run(testName, func(t *testing.T) {
+			parser := NewParser(strings.NewReader("define bonus as 2\n" +
+				"start:\n" +
+				"declare scores is typed-scores\n" +
+				"declare customers is typed-customers\n" +
+				"declare avg is number\n" +
+				"declare name is text\n" +
+				test.statement))
+			program, err := parser.Parse()
+			require.NoError(t, err)
+
+			_, err = NewCompiler(program).Compile()
+			if test.expected == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.expected)
+			}
+		})
+	}
+}
+
+func TestCompiler_BackendSentencesNotKnown(t *testing.T) {
+	previous := os.Getenv("BENTO_BACKEND")
+	defer os.Setenv("BENTO_BACKEND", previous)
+	require.NoError(t, os.Setenv("BENTO_BACKEND", "tests/backends"))
+
+	parser := NewParser(strings.NewReader("start:\n" +
+		"declare scores is typed-scores\n" +
+		"declare other is untyped\n" +
+		"copy scores to other\n" +
+		"display scores"))
+	program, err := parser.Parse()
+	require.NoError(t, err)
+
+	compiler := NewCompiler(program)
+	_, err = compiler.Compile()
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		`cannot check if sentence "copy ? to ?" is ambiguous until the ` +
+			`program is run because the bento.json of untyped does not have ` +
+			`"sentences"`,
+	}, compiler.Warnings)
+}
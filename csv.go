@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// CSVFile is the value of a "csv" variable. The file is not read until it is
+// iterated with "for each", so the options can be changed after it is opened.
+type CSVFile struct {
+	Path      string
+	Delimiter rune
+
+	// Header may be true or false to override detecting if the first row is a
+	// header.
+	Header *bool
+
+	// QuoteAll will put quotes around every field when writing, rather than
+	// only the fields that need them.
+	QuoteAll bool
+}
+
+// CSVRow is the value of a "csv-row" variable. Columns can be found by their
+// name if the file has a header.
+type CSVRow struct {
+	File   *CSVFile
+	Header []string
+	Values []string
+}
+
+func NewCSVFile(path string) *CSVFile {
+	return &CSVFile{
+		Path:      path,
+		Delimiter: ',',
+	}
+}
+
+func (file *CSVFile) String() string {
+	return file.Path
+}
+
+func (row *CSVRow) String() string {
+	return strings.Join(row.Values, string(row.File.Delimiter))
+}
+
+// Column finds a value by the column name in the header, or by the column
+// number (starting at 1).
+func (row *CSVRow) Column(column interface{}) (string, error) {
+	if number, ok := column.(*Number); ok {
+		i, err := strconv.Atoi(number.String())
+		if err != nil || i < 1 || i > len(row.Values) {
+			return "", fmt.Errorf("no column %s in %s", number, row.File)
+		}
+
+		return row.Values[i-1], nil
+	}
+
+	name := valueString(column)
+	for i, header := range row.Header {
+		if strings.EqualFold(header, name) && i < len(row.Values) {
+			return row.Values[i], nil
+		}
+	}
+
+	return "", fmt.Errorf("no column %q in %s", name, row.File)
+}
+
+func (vm *VirtualMachine) GetCSVFile(index int) (*CSVFile, error) {
+	if file, ok := vm.GetArg(index).(*CSVFile); ok {
+		return file, nil
+	}
+
+	return nil, fmt.Errorf("expected csv, but got %s", vm.GetArgType(index))
+}
+
+func (vm *VirtualMachine) GetCSVRow(index int) (*CSVRow, error) {
+	if row, ok := vm.GetArg(index).(*CSVRow); ok {
+		return row, nil
+	}
+
+	return nil, fmt.Errorf("expected csv-row, but got %s", vm.GetArgType(index))
+}
+
+func openCSV(vm *VirtualMachine, args []int) error {
+	return vm.openCSV(args[0], args[1], nil)
+}
+
+func openCSVWithHeader(vm *VirtualMachine, args []int) error {
+	header := true
+	return vm.openCSV(args[0], args[1], &header)
+}
+
+func openCSVWithoutHeader(vm *VirtualMachine, args []int) error {
+	header := false
+	return vm.openCSV(args[0], args[1], &header)
+}
+
+func (vm *VirtualMachine) openCSV(path, destination int, header *bool) error {
+	if _, err := vm.GetCSVFile(destination); err != nil {
+		return err
+	}
+
+	file := NewCSVFile(vm.path(valueString(vm.GetArg(path))))
+	file.Header = header
+
+	// Make sure the file exists now, rather than waiting until it is read.
+	if _, err := os.Stat(file.Path); err != nil {
+		return err
+	}
+
+	vm.SetArg(destination, file)
+
+	return nil
+}
+
+// createCSV replaces any existing file.
+func createCSV(vm *VirtualMachine, args []int) error {
+	if _, err := vm.GetCSVFile(args[1]); err != nil {
+		return err
+	}
+
+	file := NewCSVFile(vm.path(valueString(vm.GetArg(args[0]))))
+	if err := ioutil.WriteFile(file.Path, nil, 0644); err != nil {
+		return err
+	}
+
+	vm.SetArg(args[1], file)
+
+	return nil
+}
+
+// useCSVDelimiter accepts a single character, or "tab" since it is not
+// possible to write a tab character in text.
+func useCSVDelimiter(vm *VirtualMachine, args []int) error {
+	file, err := vm.GetCSVFile(args[1])
+	if err != nil {
+		return err
+	}
+
+	delimiter := valueString(vm.GetArg(args[0]))
+	if strings.EqualFold(delimiter, "tab") {
+		delimiter = "\t"
+	}
+
+	if utf8.RuneCountInString(delimiter) != 1 {
+		return fmt.Errorf("delimiter must be a single character or \"tab\", "+
+			"but got %q", delimiter)
+	}
+
+	file.Delimiter, _ = utf8.DecodeRuneInString(delimiter)
+
+	return nil
+}
+
+func quoteEveryCSVField(vm *VirtualMachine, args []int) error {
+	file, err := vm.GetCSVFile(args[0])
+	if err != nil {
+		return err
+	}
+
+	file.QuoteAll = true
+
+	return nil
+}
+
+// writeCSVRow is used for any number of values. The last argument is the
+// file.
+func writeCSVRow(vm *VirtualMachine, args []int) error {
+	file, err := vm.GetCSVFile(args[len(args)-1])
+	if err != nil {
+		return err
+	}
+
+	var values []string
+	for _, arg := range args[:len(args)-1] {
+		values = append(values, valueString(vm.GetArg(arg)))
+	}
+
+	f, err := os.OpenFile(file.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+		0644)
+	if err != nil {
+		return err
+	}
+
+	err = file.write(f, values)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (file *CSVFile) write(w io.Writer, values []string) error {
+	// The standard library only adds quotes where they are needed.
+	if !file.QuoteAll {
+		writer := csv.NewWriter(w)
+		writer.Comma = file.Delimiter
+		if err := writer.Write(values); err != nil {
+			return err
+		}
+
+		writer.Flush()
+
+		return writer.Error()
+	}
+
+	for i, value := range values {
+		values[i] = `"` + strings.Replace(value, `"`, `""`, -1) + `"`
+	}
+
+	_, err := io.WriteString(w,
+		strings.Join(values, string(file.Delimiter))+"\n")
+
+	return err
+}
+
+func displayCSVColumn(vm *VirtualMachine, args []int) error {
+	row, err := vm.GetCSVRow(args[1])
+	if err != nil {
+		return err
+	}
+
+	value, err := row.Column(vm.GetArg(args[0]))
+	if err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintln(vm.out, value)
+
+	return nil
+}
+
+func readCSVColumn(vm *VirtualMachine, args []int) error {
+	row, err := vm.GetCSVRow(args[1])
+	if err != nil {
+		return err
+	}
+
+	value, err := row.Column(vm.GetArg(args[0]))
+	if err != nil {
+		return err
+	}
+
+	return vm.SetArgText(args[2], value)
+}
+
+// csvHeaderSample is the number of rows after the first that are used to
+// detect the header.
+const csvHeaderSample = 20
+
+// csvRowsIterator reads one row at a time, so that a large file never has to
+// fit in memory. Only the first few rows are read ahead to detect the header.
+type csvRowsIterator struct {
+	file   *CSVFile
+	f      *os.File
+	reader *csv.Reader
+	header []string
+
+	// rows have been read ahead, but not returned yet.
+	rows [][]string
+}
+
+func (file *CSVFile) iterator() (Iterator, error) {
+	f, err := os.Open(file.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := csv.NewReader(f)
+	reader.Comma = file.Delimiter
+	reader.FieldsPerRecord = -1
+
+	iterator := &csvRowsIterator{
+		file:   file,
+		f:      f,
+		reader: reader,
+	}
+
+	for len(iterator.rows) <= csvHeaderSample {
+		row, err := iterator.read()
+		if err != nil {
+			_ = iterator.Close()
+
+			return nil, err
+		}
+
+		if row == nil {
+			break
+		}
+
+		iterator.rows = append(iterator.rows, row)
+	}
+
+	hasHeader := detectCSVHeader(iterator.rows)
+	if file.Header != nil {
+		hasHeader = *file.Header
+	}
+
+	if hasHeader && len(iterator.rows) > 0 {
+		iterator.header = iterator.rows[0]
+		iterator.rows = iterator.rows[1:]
+	}
+
+	return iterator, nil
+}
+
+func (iterator *csvRowsIterator) Next() (interface{}, bool, error) {
+	values, err := iterator.next()
+	if values == nil {
+		if closeErr := iterator.Close(); err == nil {
+			err = closeErr
+		}
+
+		return nil, false, err
+	}
+
+	row := &CSVRow{
+		File:   iterator.file,
+		Header: iterator.header,
+		Values: values,
+	}
+
+	return row, true, nil
+}
+
+// next returns nil when there are no more rows.
+func (iterator *csvRowsIterator) next() ([]string, error) {
+	if len(iterator.rows) > 0 {
+		row := iterator.rows[0]
+		iterator.rows = iterator.rows[1:]
+
+		return row, nil
+	}
+
+	return iterator.read()
+}
+
+// read returns the next row from the file, or nil at the end of the file.
+func (iterator *csvRowsIterator) read() ([]string, error) {
+	if iterator.f == nil {
+		return nil, nil
+	}
+
+	row, err := iterator.reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", iterator.file.Path, err)
+	}
+
+	return row, nil
+}
+
+// Close can be called more than once.
+func (iterator *csvRowsIterator) Close() error {
+	iterator.rows = nil
+	if iterator.f == nil {
+		return nil
+	}
+
+	err := iterator.f.Close()
+	iterator.f = nil
+
+	return err
+}
+
+// detectCSVHeader guesses if the first row is a header by comparing it to the
+// rows that follow. Each column votes for a header if the first value looks
+// different to the other values in that column. That is, it is text when the
+// others are numbers, or the others all have the same length.
+func detectCSVHeader(rows [][]string) bool {
+	if len(rows) < 2 {
+		return false
+	}
+
+	sample := rows[1:]
+	if len(sample) > 20 {
+		sample = sample[:20]
+	}
+
+	votes := 0
+	for column, header := range rows[0] {
+		allNumbers, sameLength := true, true
+		length := -1
+
+		for _, row := range sample {
+			if column >= len(row) {
+				continue
+			}
+
+			if _, ok := parseCSVNumber(row[column]); !ok {
+				allNumbers = false
+			}
+
+			if length >= 0 && len(row[column]) != length {
+				sameLength = false
+			}
+			length = len(row[column])
+		}
+
+		_, headerIsNumber := parseCSVNumber(header)
+
+		switch {
+		case allNumbers:
+			if !headerIsNumber {
+				votes++
+			} else {
+				votes--
+			}
+
+		case sameLength:
+			if len(header) != length {
+				votes++
+			} else {
+				votes--
+			}
+		}
+	}
+
+	return votes > 0
+}
+
+func parseCSVNumber(s string) (*Number, bool) {
+	number, err := ParseNumber(s, UnlimitedPrecision)
+
+	return number, err == nil && s != ""
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var detectCSVHeaderTests = map[string]struct {
+	rows     [][]string
+	expected bool
+}{
+	"Empty": {
+		rows:     nil,
+		expected: false,
+	},
+	"OnlyOneRow": {
+		rows:     [][]string{{"name", "age"}},
+		expected: false,
+	},
+	"NumberColumn": {
+		rows:     [][]string{{"name", "age"}, {"Bob", "23"}, {"Sally", "45"}},
+		expected: true,
+	},
+	"NumbersInFirstRow": {
+		rows:     [][]string{{"Jo", "18"}, {"Bob", "23"}, {"Sally", "45"}},
+		expected: false,
+	},
+	"SameLengthColumn": {
+		rows:     [][]string{{"code"}, {"AB"}, {"CD"}},
+		expected: true,
+	},
+}
+
+func TestDetectCSVHeader(t *testing.T) {
+	for testName, test := range detectCSVHeaderTests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, detectCSVHeader(test.rows))
+		})
+	}
+}
+
+func TestCSVFile_Write(t *testing.T) {
+	file := NewCSVFile("")
+	buf := bytes.NewBuffer(nil)
+
+	require.NoError(t, file.write(buf, []string{"a", "b,c", `d"e`}))
+
+	file.Delimiter = ';'
+	file.QuoteAll = true
+	require.NoError(t, file.write(buf, []string{"a", "b,c", `d"e`}))
+
+	assert.Equal(t, "a,\"b,c\",\"d\"\"e\"\n\"a\";\"b,c\";\"d\"\"e\"\n",
+		buf.String())
+}
+
+func TestCSVRow_Column(t *testing.T) {
+	row := &CSVRow{
+		File:   NewCSVFile("customers.csv"),
+		Header: []string{"Name", "Email"},
+		Values: []string{"Bob", "bob@example.com"},
+	}
+
+	value, err := row.Column(NewText("email"))
+	require.NoError(t, err)
+	assert.Equal(t, "bob@example.com", value)
+
+	value, err = row.Column(NewNumber("1", 0))
+	require.NoError(t, err)
+	assert.Equal(t, "Bob", value)
+
+	_, err = row.Column(NewText("phone"))
+	assert.EqualError(t, err, `no column "phone" in customers.csv`)
+
+	_, err = row.Column(NewNumber("3", 0))
+	assert.EqualError(t, err, `no column 3 in customers.csv`)
+}
+
+func TestCSVFile_Iterator(t *testing.T) {
+	f, err := ioutil.TempFile("", "bento-*.csv")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	// More rows than are read ahead to detect the header.
+	_, err = f.WriteString("name,count\n")
+	require.NoError(t, err)
+	for i := 1; i <= 2*csvHeaderSample; i++ {
+		_, err = fmt.Fprintf(f, "row %d,%d\n", i, i)
+		require.NoError(t, err)
+	}
+	require.NoError(t, f.Close())
+
+	iterator, err := NewCSVFile(f.Name()).iterator()
+	require.NoError(t, err)
+
+	var names []string
+	for {
+		row, ok, err := iterator.Next()
+		require.NoError(t, err)
+		if !ok {
+			break
+		}
+
+		assert.Equal(t, []string{"name", "count"}, row.(*CSVRow).Header)
+		names = append(names, row.(*CSVRow).Values[0])
+	}
+
+	require.Len(t, names, 2*csvHeaderSample)
+	assert.Equal(t, "row 1", names[0])
+	assert.Equal(t, "row 40", names[len(names)-1])
+
+	// The file is closed once all of the rows have been read.
+	assert.Nil(t, iterator.(*csvRowsIterator).f)
+}
+
+func TestCSVFile_IteratorClose(t *testing.T) {
+	iterator, err := NewCSVFile("tests/files/customers.csv").iterator()
+	require.NoError(t, err)
+
+	_, ok, err := iterator.Next()
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	closer := iterator.(io.Closer)
+	require.NoError(t, closer.Close())
+	require.NoError(t, closer.Close())
+
+	_, ok, err = iterator.Next()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// RuntimeError is an error that happened while running a program. Sentence is
+// the innermost sentence that failed, and Backend is the name of the backend
+// if the sentence was sent to one.
+type RuntimeError struct {
+	Sentence string
+	Backend  string
+	Err      error
+}
+
+func (err *RuntimeError) Error() string {
+	return err.Err.Error()
+}
+
+// The exit status of bento describes why a program did not finish. A program
+// can also choose its own exit status with "stop with status ?".
+const (
+	ExitRuntimeError       = 1
+	ExitBackendError       = 2
+	ExitBackendRetryable   = 3
+	ExitSystemCommandError = 4
+	ExitAssertionError     = 5
+	ExitParseError         = 6
+	ExitCompileError       = 7
+	ExitUsageError         = 8
+)
+
+// StopError is returned by the "stop" sentences. It is not really an error, so
+// it can never be handled by "try".
+type StopError struct {
+	Status  int
+	Message string
+}
+
+func (err *StopError) Error() string {
+	if err.Message == "" {
+		return fmt.Sprintf("stopped with status %d", err.Status)
+	}
+
+	return err.Message
+}
+
+// SystemCommandError is when a system command returns a non-zero status code,
+// and the status code is not being put into a variable.
+type SystemCommandError struct {
+	Command string
+	Status  int
+}
+
+func (err *SystemCommandError) Error() string {
+	return fmt.Sprintf("system command %q failed with status %d",
+		err.Command, err.Status)
+}
+
+// AssertionError is when the condition of an "assert" is not true.
+type AssertionError struct {
+	Assertion string
+}
+
+func (err *AssertionError) Error() string {
+	return "assertion failed: " + err.Assertion
+}
+
+// backendError returns the error reported by a backend, if that is what caused
+// err.
+func backendError(err error) *BackendError {
+	if runtimeErr, ok := err.(*RuntimeError); ok {
+		if backendErr, ok := runtimeErr.Err.(*BackendError); ok {
+			return backendErr
+		}
+	}
+
+	return nil
+}
+
+// ExitCode is the exit status used when a program stops because of err.
+func ExitCode(err error) int {
+	if stopErr, ok := err.(*StopError); ok {
+		return stopErr.Status
+	}
+
+	if runtimeErr, ok := err.(*RuntimeError); ok {
+		err = runtimeErr.Err
+	}
+
+	switch e := err.(type) {
+	case *BackendError:
+		if e.Retryable {
+			return ExitBackendRetryable
+		}
+
+		return ExitBackendError
+
+	case *SystemCommandError:
+		return ExitSystemCommandError
+
+	case *AssertionError:
+		return ExitAssertionError
+	}
+
+	return ExitRuntimeError
+}
+
+// failureIsRetryable is a question about the most recent failure handled by
+// "try".
+func failureIsRetryable(vm *VirtualMachine, args []int) error {
+	backendErr := backendError(vm.failure)
+	vm.answer = backendErr != nil && backendErr.Retryable
+
+	return nil
+}
+
+func stop(vm *VirtualMachine, args []int) error {
+	return &StopError{}
+}
+
+func stopWithStatus(vm *VirtualMachine, args []int) error {
+	status, err := vm.exitStatus(args[0])
+	if err != nil {
+		return err
+	}
+
+	return &StopError{Status: status}
+}
+
+func stopWithMessage(vm *VirtualMachine, args []int) error {
+	return &StopError{Message: valueString(vm.GetArg(args[0]))}
+}
+
+func stopWithStatusAndMessage(vm *VirtualMachine, args []int) error {
+	status, err := vm.exitStatus(args[0])
+	if err != nil {
+		return err
+	}
+
+	return &StopError{
+		Status:  status,
+		Message: valueString(vm.GetArg(args[1])),
+	}
+}
+
+func (vm *VirtualMachine) exitStatus(index int) (int, error) {
+	s := valueString(vm.GetArg(index))
+	status, err := strconv.Atoi(s)
+	if err != nil || status < 0 || status > 255 {
+		return 0, fmt.Errorf("status must be a whole number from 0 to 255, "+
+			"but got %s", s)
+	}
+
+	return status, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var exitCodeTests = map[string]struct {
+	err      error
+	expected int
+}{
+	"Runtime": {
+		err:      &RuntimeError{Err: fmt.Errorf("oops")},
+		expected: ExitRuntimeError,
+	},
+	"Backend": {
+		err:      &RuntimeError{Err: &BackendError{Message: "not found"}},
+		expected: ExitBackendError,
+	},
+	"BackendRetryable": {
+		err: &RuntimeError{
+			Err: &BackendError{Message: "database is down", Retryable: true},
+		},
+		expected: ExitBackendRetryable,
+	},
+	"SystemCommand": {
+		err:      &RuntimeError{Err: &SystemCommandError{"false", 1}},
+		expected: ExitSystemCommandError,
+	},
+	"Assertion": {
+		err:      &RuntimeError{Err: &AssertionError{"total > 0"}},
+		expected: ExitAssertionError,
+	},
+	"Stop": {
+		err:      &StopError{Status: 42},
+		expected: 42,
+	},
+	"StopWithoutStatus": {
+		err:      &StopError{Message: "done"},
+		expected: 0,
+	},
+}
+
+func TestExitCode(t *testing.T) {
+	for testName, test := range exitCodeTests {
+		t.Run(testName, func(t *testing.T) {
+			assert.Equal(t, test.expected, ExitCode(test.err))
+		})
+	}
+}
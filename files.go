@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Iterator provides each of the values for a "for each" loop. An iterator that
+// holds a resource (such as an open file) also implements io.Closer, so that it
+// can be released if the loop does not finish.
+type Iterator interface {
+	// Next returns the next value, or false when there are no more values.
+	// Text values are returned as a string so that they can be converted to
+	// the type of the loop variable.
+	Next() (value interface{}, ok bool, err error)
+}
+
+// Iterators defines all of the inbuilt sources for "for each". The syntax is
+// the part of the sentence after the loop variable.
+var Iterators = map[string]func(vm *VirtualMachine, args []int) (Iterator, error){
+	"in ?":            iterateValue,
+	"in field ? of ?": iterateJSONField,
+	"in file ?":       fileLines,
+	"matching ?":      matchingFiles,
+}
+
+// iterateValue is used for variables that contain many values, like the rows
+// of a csv.
+func iterateValue(vm *VirtualMachine, args []int) (Iterator, error) {
+	switch value := vm.GetArg(args[0]).(type) {
+	case *CSVFile:
+		return value.iterator()
+
+	case *JSONValue:
+		return value.iterator("")
+	}
+
+	return nil, fmt.Errorf("cannot use for each with %s",
+		vm.GetArgType(args[0]))
+}
+
+func readFile(vm *VirtualMachine, args []int) error {
+	data, err := ioutil.ReadFile(vm.path(valueString(vm.GetArg(args[0]))))
+	if err != nil {
+		return err
+	}
+
+	return vm.SetArgText(args[1], string(data))
+}
+
+func writeFile(vm *VirtualMachine, args []int) error {
+	return vm.writeFile(args[1], args[0], os.O_TRUNC)
+}
+
+func appendFile(vm *VirtualMachine, args []int) error {
+	return vm.writeFile(args[1], args[0], os.O_APPEND)
+}
+
+func (vm *VirtualMachine) writeFile(path, value int, flag int) error {
+	file, err := os.OpenFile(vm.path(valueString(vm.GetArg(path))),
+		os.O_WRONLY|os.O_CREATE|flag, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(file, valueString(vm.GetArg(value)))
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func deleteFile(vm *VirtualMachine, args []int) error {
+	return os.Remove(vm.path(valueString(vm.GetArg(args[0]))))
+}
+
+func copyFile(vm *VirtualMachine, args []int) error {
+	from, err := os.Open(vm.path(valueString(vm.GetArg(args[0]))))
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	to, err := os.Create(vm.path(valueString(vm.GetArg(args[1]))))
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(to, from)
+	if err != nil {
+		_ = to.Close()
+		return err
+	}
+
+	return to.Close()
+}
+
+func moveFile(vm *VirtualMachine, args []int) error {
+	return os.Rename(vm.path(valueString(vm.GetArg(args[0]))),
+		vm.path(valueString(vm.GetArg(args[1]))))
+}
+
+// fileExists is a question.
+func fileExists(vm *VirtualMachine, args []int) error {
+	_, err := os.Stat(vm.path(valueString(vm.GetArg(args[0]))))
+	vm.answer = err == nil
+
+	return nil
+}
+
+type fileLinesIterator struct {
+	file    *os.File
+	scanner *bufio.Scanner
+}
+
+func fileLines(vm *VirtualMachine, args []int) (Iterator, error) {
+	file, err := os.Open(vm.path(valueString(vm.GetArg(args[0]))))
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileLinesIterator{
+		file:    file,
+		scanner: bufio.NewScanner(file),
+	}, nil
+}
+
+func (iterator *fileLinesIterator) Next() (interface{}, bool, error) {
+	if iterator.file != nil && iterator.scanner.Scan() {
+		return iterator.scanner.Text(), true, nil
+	}
+
+	err := iterator.scanner.Err()
+	if closeErr := iterator.Close(); err == nil {
+		err = closeErr
+	}
+
+	return nil, false, err
+}
+
+// Close can be called more than once.
+func (iterator *fileLinesIterator) Close() error {
+	if iterator.file == nil {
+		return nil
+	}
+
+	err := iterator.file.Close()
+	iterator.file = nil
+
+	return err
+}
+
+type pathsIterator struct {
+	paths []string
+}
+
+// matchingFiles finds all the files that match a pattern like
+// "reports/*.csv". The paths are relative to the program in the same way as
+// the pattern so that they can be used with the other file sentences.
+func matchingFiles(vm *VirtualMachine, args []int) (Iterator, error) {
+	pattern := valueString(vm.GetArg(args[0]))
+
+	paths, err := filepath.Glob(vm.path(pattern))
+	if err != nil {
+		return nil, fmt.Errorf("bad pattern %q: %v", pattern, err)
+	}
+
+	if !filepath.IsAbs(pattern) && vm.dir != "" {
+		for i, path := range paths {
+			paths[i], err = filepath.Rel(vm.dir, path)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return &pathsIterator{paths: paths}, nil
+}
+
+func (iterator *pathsIterator) Next() (interface{}, bool, error) {
+	if len(iterator.paths) == 0 {
+		return nil, false, nil
+	}
+
+	path := iterator.paths[0]
+	iterator.paths = iterator.paths[1:]
+
+	return path, true, nil
+}
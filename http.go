@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultRequestTimeout is used for HTTP requests until the program sets its
+// own with "use request timeout of ? seconds".
+const DefaultRequestTimeout = 30 * time.Second
+
+// httpOptions apply to every HTTP request made after they are set.
+type httpOptions struct {
+	header  http.Header
+	timeout time.Duration
+}
+
+func (vm *VirtualMachine) httpOptions() *httpOptions {
+	if vm.http == nil {
+		vm.http = &httpOptions{
+			header:  http.Header{},
+			timeout: DefaultRequestTimeout,
+		}
+	}
+
+	return vm.http
+}
+
+// request sends an HTTP request. The error is only for when a response could
+// not be received at all. It is up to the caller to decide what status codes
+// are OK.
+func (vm *VirtualMachine) request(method, url string, body io.Reader, contentType string) (*http.Response, []byte, error) {
+	options := vm.httpOptions()
+
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	for name, values := range options.header {
+		request.Header[name] = values
+	}
+
+	client := &http.Client{Timeout: options.timeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s %s: %v", method, url, err)
+	}
+
+	return response, data, nil
+}
+
+// fetch is used by "fetch ? into ?" and "fetch ? into ? status code into ?".
+func fetch(vm *VirtualMachine, args []int) error {
+	url := valueString(vm.GetArg(args[0]))
+	response, data, err := vm.request(http.MethodGet, url, nil, "")
+	if err != nil {
+		return err
+	}
+
+	return vm.setResponse(http.MethodGet, url, response, data, args[1:])
+}
+
+// post is used by "post ? to ? into ?" and
+// "post ? to ? into ? status code into ?".
+func post(vm *VirtualMachine, args []int) error {
+	// A json variable is sent as JSON. Anything else is sent as plain text,
+	// unless a "Content-Type" header has been set.
+	body := valueString(vm.GetArg(args[0]))
+	contentType := "text/plain; charset=utf-8"
+	if _, ok := vm.GetArg(args[0]).(*JSONValue); ok {
+		contentType = "application/json"
+	}
+
+	url := valueString(vm.GetArg(args[1]))
+	response, data, err := vm.request(http.MethodPost, url,
+		bytes.NewBufferString(body), contentType)
+	if err != nil {
+		return err
+	}
+
+	return vm.setResponse(http.MethodPost, url, response, data, args[2:])
+}
+
+// setResponse puts the response body into the first destination, parsing it if
+// the destination is json. A status code that is not 2xx is an error, unless
+// there is a second destination for the status code so that the program can
+// check it.
+func (vm *VirtualMachine) setResponse(method, url string, response *http.Response, data []byte, destinations []int) error {
+	if len(destinations) > 1 {
+		err := vm.SetArgText(destinations[1], strconv.Itoa(response.StatusCode))
+		if err != nil {
+			return err
+		}
+	} else if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s %s: %s", method, url, response.Status)
+	}
+
+	if _, ok := vm.GetArg(destinations[0]).(*JSONValue); ok {
+		value, err := ParseJSON(string(data))
+		if err != nil {
+			return fmt.Errorf("%s %s: %v", method, url, err)
+		}
+
+		vm.SetArg(destinations[0], value)
+
+		return nil
+	}
+
+	return vm.SetArgText(destinations[0], string(data))
+}
+
+func useHeader(vm *VirtualMachine, args []int) error {
+	vm.httpOptions().header.Set(valueString(vm.GetArg(args[0])),
+		valueString(vm.GetArg(args[1])))
+
+	return nil
+}
+
+func useBearerToken(vm *VirtualMachine, args []int) error {
+	vm.httpOptions().header.Set("Authorization",
+		"Bearer "+valueString(vm.GetArg(args[0])))
+
+	return nil
+}
+
+func useBasicAuth(vm *VirtualMachine, args []int) error {
+	credentials := valueString(vm.GetArg(args[0])) + ":" +
+		valueString(vm.GetArg(args[1]))
+	vm.httpOptions().header.Set("Authorization",
+		"Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+
+	return nil
+}
+
+func useRequestTimeout(vm *VirtualMachine, args []int) error {
+	seconds, err := strconv.ParseFloat(valueString(vm.GetArg(args[0])), 64)
+	if err != nil || seconds <= 0 {
+		return fmt.Errorf("request timeout must be a positive number of "+
+			"seconds, but got %s", valueString(vm.GetArg(args[0])))
+	}
+
+	vm.httpOptions().timeout = time.Duration(seconds * float64(time.Second))
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var httpTests = map[string]struct {
+	bento          string
+	expectedOutput string
+	expectedError  string
+}{
+	"Fetch": {
+		bento: "start: declare body is text\n" +
+			"fetch \"URL/customer\" into body\n" +
+			"display body",
+		expectedOutput: `{"email": "bob@example.com", "total": 12.5}` + "\n",
+	},
+	"FetchIntoJSON": {
+		bento: "start: declare customer is json\n" +
+			"declare total is number with 1 decimal place\n" +
+			"fetch \"URL/customer\" into customer\n" +
+			"read field \"total\" of customer into total\n" +
+			"display total",
+		expectedOutput: "12.5\n",
+	},
+	"FetchNotFound": {
+		bento: "start: declare body is text\n" +
+			"fetch \"URL/missing\" into body",
+		expectedError: "GET URL/missing: 404 Not Found",
+	},
+	"FetchStatusCode": {
+		bento: "start: declare body is text\n" +
+			"declare status is number\n" +
+			"fetch \"URL/missing\" into body status code into status\n" +
+			"display status \" \" body",
+		expectedOutput: "404 not found\n",
+	},
+	"FetchNetworkFailure": {
+		bento: "start: declare body is text\n" +
+			"declare status is number\n" +
+			"fetch \"http://127.0.0.1:0/\" into body status code into status",
+		expectedError: "connect:",
+	},
+	"PostText": {
+		bento: "start: declare body is text\n" +
+			"post \"hello\" to \"URL/echo\" into body\n" +
+			"display body",
+		expectedOutput: "POST text/plain; charset=utf-8 hello\n",
+	},
+	"PostJSON": {
+		bento: "start: declare request is json\n" +
+			"declare body is text\n" +
+			"declare status is number\n" +
+			"set field \"name\" of request to \"Bob\"\n" +
+			"post request to \"URL/echo\" into body status code into status\n" +
+			"display status \" \" body",
+		expectedOutput: `200 POST application/json {"name":"Bob"}` + "\n",
+	},
+	"Headers": {
+		bento: "start: declare body is text\n" +
+			"use header \"X-Request-Id\" with value 123\n" +
+			"use bearer token \"secret\"\n" +
+			"fetch \"URL/headers\" into body\n" +
+			"display body\n" +
+			"use basic auth \"bob\" with password \"pa55\"\n" +
+			"use header \"Content-Type\" with value \"text/csv\"\n" +
+			"post \"a,b\" to \"URL/headers\" into body\n" +
+			"display body",
+		expectedOutput: "123 Bearer secret \n" +
+			"123 Basic Ym9iOnBhNTU= text/csv\n",
+	},
+	"Timeout": {
+		bento: "start: declare body is text\n" +
+			"use request timeout of 0.05 seconds\n" +
+			"fetch \"URL/slow\" into body",
+		expectedError: "Client.Timeout exceeded",
+	},
+	"InvalidTimeout": {
+		bento:         "start: use request timeout of 0 seconds",
+		expectedError: "request timeout must be a positive number of seconds, but got 0",
+	},
+}
+
+func TestHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/customer":
+				_, _ = fmt.Fprint(w, `{"email": "bob@example.com", "total": 12.5}`)
+
+			case "/echo":
+				body, _ := ioutil.ReadAll(r.Body)
+				_, _ = fmt.Fprintf(w, "%s %s %s", r.Method,
+					r.Header.Get("Content-Type"), body)
+
+			case "/headers":
+				_, _ = fmt.Fprintf(w, "%s %s %s", r.Header.Get("X-Request-Id"),
+					r.Header.Get("Authorization"), r.Header.Get("Content-Type"))
+
+			case "/slow":
+				time.Sleep(time.Second)
+
+			default:
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = fmt.Fprint(w, "not found")
+			}
+		}))
+	defer server.Close()
+
+	for testName, test := range httpTests {
+		t.Run(testName, func(t *testing.T) {
+			bento := strings.Replace(test.bento, "URL", server.URL, -1)
+			parser := NewParser(strings.NewReader(bento))
+			program, err := parser.Parse()
+			require.NoError(t, err)
+
+			compiledProgram, err := NewCompiler(program).Compile()
+			require.NoError(t, err)
+
+			vm := NewVirtualMachine(compiledProgram)
+			vm.out = bytes.NewBuffer(nil)
+			err = vm.Run()
+
+			if test.expectedError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(),
+					strings.Replace(test.expectedError, "URL", server.URL, -1))
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedOutput, vm.out.(*bytes.Buffer).String())
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// isTerminal will be true if a person is able to type into the file (usually
+// stdin) or read what is written to it, rather than it being a pipe, file or
+// /dev/null.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+
+	// /dev/null is also a character device, but nobody will ever type into
+	// it. This is common for scheduled jobs.
+	devNull, err := os.Stat(os.DevNull)
+
+	return err != nil || !os.SameFile(info, devNull)
+}
+
+// readLine reads a single line without the new line character. It reads one
+// byte at a time so that nothing after the line is consumed from r.
+func readLine(r io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+
+	for {
+		n, err := r.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				break
+			}
+
+			line = append(line, b[0])
+		}
+
+		if err == io.EOF && len(line) > 0 {
+			break
+		}
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return strings.TrimRight(string(line), "\r"), nil
+}
+
+// readAnswer shows the prompt and waits for a single line of input.
+func (vm *VirtualMachine) readAnswer(prompt string) (string, error) {
+	// The prompt usually ends with a space, which is not useful in an error.
+	quoted := strconv.Quote(strings.TrimSpace(prompt))
+
+	if vm.in == nil {
+		return "", fmt.Errorf("cannot ask %s because input is not "+
+			"available when running non-interactively", quoted)
+	}
+
+	_, _ = fmt.Fprint(vm.out, prompt)
+
+	answer, err := readLine(vm.in)
+	if err == io.EOF {
+		return "", fmt.Errorf("no answer was given for %s", quoted)
+	}
+
+	return strings.TrimSpace(answer), err
+}
+
+// ask will keep asking until a valid value for the destination is entered.
+func ask(vm *VirtualMachine, args []int) error {
+	question := valueString(vm.GetArg(args[0]))
+
+	for {
+		answer, err := vm.readAnswer(question + " ")
+		if err != nil {
+			return err
+		}
+
+		err = vm.SetArgText(args[1], answer)
+		if err == nil {
+			return nil
+		}
+
+		_, _ = fmt.Fprintln(vm.out, err)
+	}
+}
+
+// confirm is a question that is answered by the person running the program.
+func confirm(vm *VirtualMachine, args []int) error {
+	question := valueString(vm.GetArg(args[0]))
+
+	for {
+		answer, err := vm.readAnswer(question + " (yes/no) ")
+		if err != nil {
+			return err
+		}
+
+		switch strings.ToLower(answer) {
+		case "y", "yes":
+			vm.answer = true
+			return nil
+
+		case "n", "no":
+			vm.answer = false
+			return nil
+		}
+
+		_, _ = fmt.Fprintln(vm.out, `Please answer "yes" or "no".`)
+	}
+}
+
+// choose shows a numbered menu. The last argument is the destination, all of
+// the others are the options.
+func choose(vm *VirtualMachine, args []int) error {
+	options := args[:len(args)-1]
+	destination := args[len(args)-1]
+
+	for i, option := range options {
+		_, _ = fmt.Fprintf(vm.out, "%d. %s\n", i+1,
+			valueString(vm.GetArg(option)))
+	}
+
+	for {
+		answer, err := vm.readAnswer(fmt.Sprintf("Choose 1-%d: ", len(options)))
+		if err != nil {
+			return err
+		}
+
+		// The option can be chosen by number or by typing the option itself.
+		chosen, err := strconv.Atoi(answer)
+		if err != nil {
+			for i, option := range options {
+				if strings.EqualFold(answer, valueString(vm.GetArg(option))) {
+					chosen = i + 1
+				}
+			}
+		}
+
+		if chosen >= 1 && chosen <= len(options) {
+			return vm.SetArgText(destination,
+				valueString(vm.GetArg(options[chosen-1])))
+		}
+
+		_, _ = fmt.Fprintf(vm.out, "Please choose a number from 1 to %d.\n",
+			len(options))
+	}
+}
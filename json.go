@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// JSONValue is the value of a "json" variable. Value is anything decoded by
+// encoding/json, except that numbers are always a json.Number so that they
+// never lose precision.
+type JSONValue struct {
+	Value interface{}
+}
+
+// ParseJSON decodes JSON text.
+func ParseJSON(s string) (*JSONValue, error) {
+	decoder := json.NewDecoder(strings.NewReader(s))
+	decoder.UseNumber()
+
+	value := new(JSONValue)
+	if err := decoder.Decode(&value.Value); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+
+	return value, nil
+}
+
+// String returns the compact JSON text.
+func (value *JSONValue) String() string {
+	data, _ := json.Marshal(value.Value)
+
+	return string(data)
+}
+
+// Copy is a deep copy so that changing fields of one variable can never affect
+// another.
+func (value *JSONValue) Copy() *JSONValue {
+	copied, _ := ParseJSON(value.String())
+
+	return copied
+}
+
+// parseJSONPath splits a path like "customer.orders[0].total" or
+// "customer.orders.0.total" into each key.
+func parseJSONPath(path string) []string {
+	path = strings.Replace(path, "[", ".", -1)
+	path = strings.Replace(path, "]", "", -1)
+
+	return strings.Split(strings.Trim(path, "."), ".")
+}
+
+// Field finds a value by its path. An empty path is the whole value.
+func (value *JSONValue) Field(path string) (interface{}, error) {
+	current := value.Value
+	if path == "" {
+		return current, nil
+	}
+
+	for _, key := range parseJSONPath(path) {
+		switch v := current.(type) {
+		case map[string]interface{}:
+			next, ok := v[key]
+			if !ok {
+				return nil, fmt.Errorf("no such field %q", path)
+			}
+
+			current = next
+
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, fmt.Errorf("no such field %q", path)
+			}
+
+			current = v[i]
+
+		default:
+			return nil, fmt.Errorf("no such field %q", path)
+		}
+	}
+
+	return current, nil
+}
+
+// SetField will create any objects that do not exist along the path. An array
+// element can be replaced, or added to the end by using the next index.
+func (value *JSONValue) SetField(path string, fieldValue interface{}) error {
+	var err error
+	value.Value, err = setJSONField(value.Value, parseJSONPath(path),
+		fieldValue, path)
+
+	return err
+}
+
+func setJSONField(current interface{}, keys []string, value interface{}, path string) (interface{}, error) {
+	if len(keys) == 0 {
+		return value, nil
+	}
+
+	key := keys[0]
+
+	switch v := current.(type) {
+	case nil:
+		child, err := setJSONField(nil, keys[1:], value, path)
+		if err != nil {
+			return current, err
+		}
+
+		return map[string]interface{}{key: child}, nil
+
+	case map[string]interface{}:
+		child, err := setJSONField(v[key], keys[1:], value, path)
+		if err != nil {
+			return current, err
+		}
+
+		v[key] = child
+
+		return v, nil
+
+	case []interface{}:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i > len(v) {
+			return current, fmt.Errorf("cannot set field %q", path)
+		}
+
+		var element interface{}
+		if i < len(v) {
+			element = v[i]
+		}
+
+		child, err := setJSONField(element, keys[1:], value, path)
+		if err != nil {
+			return current, err
+		}
+
+		if i == len(v) {
+			return append(v, child), nil
+		}
+
+		v[i] = child
+
+		return v, nil
+	}
+
+	return current, fmt.Errorf("cannot set field %q", path)
+}
+
+// Length is the number of elements in an array, or keys in an object.
+func jsonLength(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case []interface{}:
+		return len(v), nil
+
+	case map[string]interface{}:
+		return len(v), nil
+	}
+
+	return 0, fmt.Errorf("cannot get length of %s", jsonTypeName(value))
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+
+	case bool:
+		return "boolean"
+
+	case json.Number:
+		return "number"
+
+	case string:
+		return "text"
+
+	case []interface{}:
+		return "array"
+	}
+
+	return "object"
+}
+
+// GetJSON accepts a json variable, or text containing JSON.
+func (vm *VirtualMachine) GetJSON(index int) (*JSONValue, error) {
+	switch value := vm.GetArg(index).(type) {
+	case *JSONValue:
+		return value, nil
+
+	case *string:
+		return ParseJSON(*value)
+	}
+
+	return nil, fmt.Errorf("expected json, but got %s", vm.GetArgType(index))
+}
+
+// SetArgJSON converts a JSON value to the type of the destination variable.
+// Numbers are rounded to the precision of the destination.
+func (vm *VirtualMachine) SetArgJSON(index int, value interface{}) error {
+	switch destination := vm.GetArg(index).(type) {
+	case *string:
+		if s, ok := value.(string); ok {
+			vm.SetArg(index, NewText(s))
+		} else {
+			vm.SetArg(index, NewText((&JSONValue{value}).String()))
+		}
+
+	case *Number:
+		var s string
+		switch v := value.(type) {
+		case json.Number:
+			s = string(v)
+
+		case string:
+			s = v
+
+		default:
+			return fmt.Errorf("expected number, but got %s",
+				jsonTypeName(value))
+		}
+
+		number, err := ParseNumber(s, UnlimitedPrecision)
+		if err != nil {
+			return err
+		}
+
+		destination.Set(number)
+
+	case *JSONValue:
+		vm.SetArg(index, (&JSONValue{value}).Copy())
+
+	case nil: // blackhole
+
+	default:
+		return fmt.Errorf("cannot set %s from json", vm.GetArgType(index))
+	}
+
+	return nil
+}
+
+// newJSONFieldValue converts a variable into a JSON value.
+func (vm *VirtualMachine) newJSONFieldValue(index int) (interface{}, error) {
+	switch value := vm.GetArg(index).(type) {
+	case *string:
+		return *value, nil
+
+	case *Number:
+		return json.Number(value.String()), nil
+
+	case *JSONValue:
+		return value.Copy().Value, nil
+
+	case nil:
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("cannot put %s into json", vm.GetArgType(index))
+}
+
+func readJSONField(vm *VirtualMachine, args []int) error {
+	document, err := vm.GetJSON(args[1])
+	if err != nil {
+		return err
+	}
+
+	value, err := document.Field(valueString(vm.GetArg(args[0])))
+	if err != nil {
+		return err
+	}
+
+	return vm.SetArgJSON(args[2], value)
+}
+
+func readJSONLength(vm *VirtualMachine, args []int) error {
+	document, err := vm.GetJSON(args[0])
+	if err != nil {
+		return err
+	}
+
+	length, err := jsonLength(document.Value)
+	if err != nil {
+		return err
+	}
+
+	return vm.SetArgText(args[1], strconv.Itoa(length))
+}
+
+func readJSONFieldLength(vm *VirtualMachine, args []int) error {
+	document, err := vm.GetJSON(args[1])
+	if err != nil {
+		return err
+	}
+
+	path := valueString(vm.GetArg(args[0]))
+	value, err := document.Field(path)
+	if err != nil {
+		return err
+	}
+
+	length, err := jsonLength(value)
+	if err != nil {
+		return fmt.Errorf("field %q: %v", path, err)
+	}
+
+	return vm.SetArgText(args[2], strconv.Itoa(length))
+}
+
+// jsonFieldExists is a question.
+func jsonFieldExists(vm *VirtualMachine, args []int) error {
+	document, err := vm.GetJSON(args[1])
+	if err != nil {
+		return err
+	}
+
+	_, err = document.Field(valueString(vm.GetArg(args[0])))
+	vm.answer = err == nil
+
+	return nil
+}
+
+func setJSONFieldSentence(vm *VirtualMachine, args []int) error {
+	document, ok := vm.GetArg(args[1]).(*JSONValue)
+	if !ok {
+		return fmt.Errorf("expected json, but got %s", vm.GetArgType(args[1]))
+	}
+
+	value, err := vm.newJSONFieldValue(args[2])
+	if err != nil {
+		return err
+	}
+
+	return document.SetField(valueString(vm.GetArg(args[0])), value)
+}
+
+type jsonArrayIterator struct {
+	values []interface{}
+}
+
+func (value *JSONValue) iterator(path string) (Iterator, error) {
+	field, err := value.Field(path)
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := field.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot use for each with %s",
+			jsonTypeName(field))
+	}
+
+	return &jsonArrayIterator{values: values}, nil
+}
+
+func (iterator *jsonArrayIterator) Next() (interface{}, bool, error) {
+	if len(iterator.values) == 0 {
+		return nil, false, nil
+	}
+
+	value := iterator.values[0]
+	iterator.values = iterator.values[1:]
+
+	return &JSONValue{Value: value}, true, nil
+}
+
+func iterateJSONField(vm *VirtualMachine, args []int) (Iterator, error) {
+	document, err := vm.GetJSON(args[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return document.iterator(valueString(vm.GetArg(args[0])))
+}
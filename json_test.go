@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+var jsonFieldTests = map[string]struct {
+	path     string
+	expected interface{}
+	err      string
+}{
+	"Whole":        {path: "", expected: "*"},
+	"Object":       {path: "customer.email", expected: "bob@example.com"},
+	"Number":       {path: "customer.orders.1.total", expected: json.Number("12.345")},
+	"Brackets":     {path: "customer.orders[0].total", expected: json.Number("3")},
+	"MissingKey":   {path: "customer.phone", err: `no such field "customer.phone"`},
+	"OutOfRange":   {path: "customer.orders.2", err: `no such field "customer.orders.2"`},
+	"NotAnIndex":   {path: "customer.orders.foo", err: `no such field "customer.orders.foo"`},
+	"IntoAScalar":  {path: "customer.email.foo", err: `no such field "customer.email.foo"`},
+	"ArrayElement": {path: "tags.1", expected: "b"},
+}
+
+const jsonFieldTestDocument = `{
+	"customer": {
+		"email": "bob@example.com",
+		"orders": [{"total": 3}, {"total": 12.345}]
+	},
+	"tags": ["a", "b"]
+}`
+
+func TestJSONValue_Field(t *testing.T) {
+	document, err := ParseJSON(jsonFieldTestDocument)
+	require.NoError(t, err)
+
+	for testName, test := range jsonFieldTests {
+		t.Run(testName, func(t *testing.T) {
+			value, err := document.Field(test.path)
+
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+
+			require.NoError(t, err)
+
+			if test.expected == "*" {
+				assert.Equal(t, document.Value, value)
+			} else {
+				assert.Equal(t, test.expected, value)
+			}
+		})
+	}
+}
+
+func TestJSONValue_SetField(t *testing.T) {
+	document := &JSONValue{}
+
+	require.NoError(t, document.SetField("customer.email", "bob@example.com"))
+	require.NoError(t, document.SetField("customer.total", json.Number("1.50")))
+	require.NoError(t, document.SetField("tags", []interface{}{}))
+	require.NoError(t, document.SetField("tags.0", "a"))
+	require.NoError(t, document.SetField("tags[1]", "b"))
+
+	assert.Equal(t, `{"customer":{"email":"bob@example.com","total":1.50},`+
+		`"tags":["a","b"]}`, document.String())
+
+	assert.EqualError(t, document.SetField("tags.5", "c"),
+		`cannot set field "tags.5"`)
+	assert.EqualError(t, document.SetField("customer.email.foo", "c"),
+		`cannot set field "customer.email.foo"`)
+}
+
+func TestParseJSON(t *testing.T) {
+	_, err := ParseJSON(`{"foo":`)
+	assert.EqualError(t, err, "invalid JSON: unexpected EOF")
+}
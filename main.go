@@ -6,10 +6,15 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 )
 
 var (
-	flagAst bool
+	flagAst            bool
+	flagNonInteractive bool
 )
 
 func main() {
@@ -17,18 +22,36 @@ func main() {
 		"exist. This is useful for debugging, but you should not assume that "+
 		"the format returned will be consistent or if -ast will remain in "+
 		"any future version.")
+	flag.BoolVar(&flagNonInteractive, "non-interactive", false, "Never "+
+		"wait for input. Any sentence that needs an answer (such as ask) "+
+		"or a missing argument will be an error instead.")
 	flag.Parse()
 
-	for _, arg := range flag.Args() {
+	// "bento backends" lists the backends, rather than running a file.
+	if flag.NArg() == 1 && flag.Arg(0) == "backends" {
+		if !listBackends(os.Stdout) {
+			os.Exit(ExitBackendError)
+		}
+
+		return
+	}
+
+	// Everything after the file names are the arguments for start, like:
+	//
+	//   bento report.bento --days 7 --customer 123
+	//
+	files, startArgs := splitArgs(flag.Args())
+
+	for _, arg := range files {
 		file, err := os.Open(arg)
 		if err != nil {
-			log.Fatalln(err)
+			fail(ExitUsageError, err)
 		}
 
 		parser := NewParser(file)
 		program, err := parser.Parse()
 		if err != nil {
-			log.Fatalln(err)
+			fail(ExitParseError, err)
 		}
 
 		if flagAst {
@@ -41,13 +64,132 @@ func main() {
 		}
 
 		compiler := NewCompiler(program)
-		compiledProgram := compiler.Compile()
+		compiledProgram, err := compiler.Compile()
+		if err != nil {
+			fail(ExitCompileError, err)
+		}
+
+		for _, warning := range compiler.Warnings {
+			log.Println("warning:", warning)
+		}
+
+		// Missing arguments can only be asked for if there is someone there
+		// to answer.
+		var prompt Prompter
+		if isTerminal(os.Stdin) && !flagNonInteractive {
+			prompt = promptArgument
+		}
+
+		args, err := ParseStartArguments(program.Functions["start"],
+			startArgs, prompt)
+		if err != nil {
+			fail(ExitUsageError, err)
+		}
 
 		vm := NewVirtualMachine(compiledProgram)
-		err = vm.Run()
+		vm.dir = filepath.Dir(arg)
+		vm.terminal = isTerminal(os.Stdout)
+		if flagNonInteractive {
+			vm.in = nil
+		}
+
+		stopSignals := closeOnSignal(vm)
+		err = vm.Run(args...)
+		stopSignals()
+
+		// Stopping is not an error, so the message is written as it is.
+		if stopErr, ok := err.(*StopError); ok {
+			if stopErr.Message != "" {
+				_, _ = fmt.Fprintln(os.Stderr, stopErr.Message)
+			}
+
+			os.Exit(stopErr.Status)
+		}
 
 		if err != nil {
-			log.Fatalln(err)
+			log.Println(err)
+
+			// The details from a backend are only for debugging, so they are
+			// never shown to the program.
+			if backendErr := backendError(err); backendErr != nil {
+				if backendErr.Code != "" {
+					log.Println("code:", backendErr.Code)
+				}
+
+				if len(backendErr.Details) > 0 {
+					log.Println("details:", string(backendErr.Details))
+				}
+			}
+
+			os.Exit(ExitCode(err))
 		}
 	}
 }
+
+// closeOnSignal makes sure that backends are shut down when bento is
+// interrupted (such as with Ctrl-C) or terminated. A request that a backend is
+// handling is cancelled first. The returned function must be called once the
+// program has finished.
+func closeOnSignal(vm *VirtualMachine) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	// finished is only closed if there was no signal. Otherwise the process
+	// exits while it is being handled.
+	finished := make(chan struct{})
+
+	go func() {
+		s, ok := <-signals
+		if !ok {
+			close(finished)
+
+			return
+		}
+
+		vm.Close()
+
+		// This is the conventional exit status for a process that was
+		// stopped by a signal.
+		status := ExitRuntimeError
+		if number, ok := s.(syscall.Signal); ok {
+			status = 128 + int(number)
+		}
+
+		os.Exit(status)
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+
+		// The cancelled request causes the program to fail, but that must
+		// not be reported because the program was interrupted.
+		<-finished
+	}
+}
+
+// fail is used for errors before the program can be run.
+func fail(status int, err error) {
+	log.Println(err)
+	os.Exit(status)
+}
+
+func splitArgs(args []string) (files, startArgs []string) {
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "--") {
+			return args[:i], args[i:]
+		}
+	}
+
+	return args, nil
+}
+
+func promptArgument(argument *VariableDefinition, problem error) (string, error) {
+	if problem != nil {
+		fmt.Println(problem)
+	}
+
+	fmt.Printf("%s (%s): ", argument.Name, argument.Type)
+
+	return readLine(os.Stdin)
+}
@@ -36,10 +36,21 @@ func TestBentoFiles(t *testing.T) {
 			require.NoError(t, err)
 
 			compiler := NewCompiler(program)
-			compiledProgram := compiler.Compile()
+			compiledProgram, err := compiler.Compile()
+			require.NoError(t, err)
 
 			vm := NewVirtualMachine(compiledProgram)
 			vm.out = bytes.NewBuffer(nil)
+			vm.dir = dir
+
+			// Answers for any questions asked are read from an optional
+			// input file.
+			vm.in = bytes.NewBuffer(nil)
+			inputFilePath := dir + strings.Replace(fileInfo.Name(), ".bento", ".in", -1)
+			if inputData, err := ioutil.ReadFile(inputFilePath); err == nil {
+				vm.in = bytes.NewBuffer(inputData)
+			}
+
 			err = vm.Run()
 			require.NoError(t, err)
 
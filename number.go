@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"math/big"
 	"strings"
 )
@@ -29,6 +30,29 @@ func NewNumber(s string, precision int) *Number {
 	}
 }
 
+// ParseNumber is used for values that come from outside of the program, such
+// as user input. Unlike NewNumber, the value is validated and must not have
+// more decimal places than the precision allows.
+func ParseNumber(s string, precision int) (*Number, error) {
+	rat, ok := big.NewRat(0, 1).SetString(strings.TrimSpace(s))
+	if !ok {
+		return nil, fmt.Errorf(`"%s" is not a number`, s)
+	}
+
+	number := &Number{
+		Rat:       rat,
+		Precision: precision,
+	}
+
+	rounded, _ := big.NewRat(0, 1).SetString(rat.FloatString(precision))
+	if rounded.Cmp(rat) != 0 {
+		return nil, fmt.Errorf("%s has more than %d decimal places",
+			strings.TrimSpace(s), precision)
+	}
+
+	return number, nil
+}
+
 func (number *Number) String() string {
 	s := number.Rat.FloatString(number.Precision)
 
@@ -41,6 +65,11 @@ func (number *Number) String() string {
 	return strings.TrimRight(s, ".")
 }
 
+// MarshalJSON is used by -ast so that numbers appear as their exact value.
+func (number *Number) MarshalJSON() ([]byte, error) {
+	return []byte(number.String()), nil
+}
+
 func (number *Number) Cmp(number2 *Number) int {
 	return number.Rat.Cmp(number2.Rat)
 }
@@ -15,9 +15,17 @@ import (
 // These reserved words have special meaning when they are the first word of the
 // sentence. It's fine to include them as normal words inside a sentence.
 const (
+	WordAssert    = "assert"
 	WordDeclare   = "declare"
+	WordDefine    = "define"
+	WordEach      = "each"
+	WordFailure   = "failure"
+	WordFinally   = "finally"
+	WordFor       = "for"
 	WordIf        = "if"
+	WordOn        = "on"
 	WordOtherwise = "otherwise"
+	WordTry       = "try"
 	WordUnless    = "unless"
 	WordUntil     = "until"
 	WordWhile     = "while"
@@ -45,10 +53,28 @@ func (parser *Parser) Parse() (*Program, error) {
 
 	parser.program = &Program{
 		Functions: map[string]*Function{},
+		UsesTry:   parser.usesTry(),
 	}
 
 	// Now we can compile the program.
 	for !parser.isFinished() {
+		// File-level variables and constants must be declared before the first
+		// function. Otherwise they would be indistinguishable from the local
+		// variables of the function above them.
+		if len(parser.program.Functions) == 0 {
+			definition, err := parser.consumeDeclare()
+			if err == nil {
+				parser.program.AppendVariable(definition)
+				continue
+			}
+
+			constant, err := parser.consumeDefine()
+			if err == nil {
+				parser.program.AppendConstant(constant)
+				continue
+			}
+		}
+
 		function, err := parser.consumeFunction()
 		if err != nil {
 			return nil, err
@@ -313,7 +339,7 @@ func (parser *Parser) consumeVariableIsType() (definition *VariableDefinition, e
 }
 
 // foo is text, bar is text
-func (parser *Parser) consumeVariableIsTypeList() (list map[string]*VariableDefinition, err error) {
+func (parser *Parser) consumeVariableIsTypeList() (list []*VariableDefinition, err error) {
 	originalOffset := parser.offset
 	defer func() {
 		if err != nil {
@@ -321,15 +347,13 @@ func (parser *Parser) consumeVariableIsTypeList() (list map[string]*VariableDefi
 		}
 	}()
 
-	list = map[string]*VariableDefinition{}
-
 	for !parser.isFinished() {
 		definition, err := parser.consumeVariableIsType()
 		if err != nil {
 			return nil, err
 		}
 
-		list[definition.Name] = definition
+		list = append(list, definition)
 
 		err = parser.consumeComma()
 		if err != nil {
@@ -353,6 +377,10 @@ func (parser *Parser) consumeSentence(varMap map[string]*VariableDefinition) (se
 	for !parser.isFinished() {
 		word, err := parser.consumeSentenceWord(varMap)
 		if err != nil {
+			if isListSentence(sentence.Words) && parser.consumeListSeparator() {
+				continue
+			}
+
 			break
 		}
 
@@ -362,6 +390,59 @@ func (parser *Parser) consumeSentence(varMap map[string]*VariableDefinition) (se
 	return
 }
 
+// ListSentences are the words at the start of each sentence that allows its
+// values to be separated by commas, like:
+//
+//   choose one of "daily", "weekly", "monthly" into period
+var ListSentences = [][]string{
+	{"choose", "one", "of"},
+	{"write", "row"},
+}
+
+// isListSentence is true if the words so far are the start of one of the
+// ListSentences. Any other sentence ends at a comma.
+func isListSentence(words []interface{}) bool {
+	for _, prefix := range ListSentences {
+		if len(words) <= len(prefix) {
+			continue
+		}
+
+		matches := true
+		for i, word := range prefix {
+			// A variable can have the same name as a word, such as "row".
+			if words[i] != word && words[i] != VariableReference(word) {
+				matches = false
+
+				break
+			}
+		}
+
+		if matches {
+			return true
+		}
+	}
+
+	return false
+}
+
+// consumeListSeparator allows the values in a list sentence to be separated by
+// commas. The comma is only a separator when it is followed by text or a
+// number. Otherwise it is the end of the sentence, such as in an inline "if".
+func (parser *Parser) consumeListSeparator() bool {
+	originalOffset := parser.offset
+
+	if parser.consumeComma() == nil {
+		switch parser.tokens[parser.offset].Kind {
+		case TokenKindText, TokenKindNumber:
+			return true
+		}
+	}
+
+	parser.offset = originalOffset
+
+	return false
+}
+
 func (parser *Parser) consumeQuestionAnswer() (answer *QuestionAnswer, err error) {
 	originalOffset := parser.offset
 	defer func() {
@@ -476,23 +557,46 @@ func (parser *Parser) consumeFunction() (function *Function, err error) {
 			continue
 		}
 
+		varMap := parser.variableMap(function)
+
 		// if/unless ...
-		ifStmt, err := parser.consumeIf(function.VariableMap())
+		ifStmt, err := parser.consumeIf(varMap)
 		if err == nil {
 			function.AppendStatement(ifStmt)
 			continue
 		}
 
 		// while/until ...
-		whileStmt, err := parser.consumeWhile(function.VariableMap())
+		whileStmt, err := parser.consumeWhile(varMap)
 		if err == nil {
 			function.AppendStatement(whileStmt)
 			continue
 		}
 
+		// for each ...
+		forEachStmt, err := parser.consumeForEach(varMap)
+		if err == nil {
+			function.AppendStatement(forEachStmt)
+			continue
+		}
+
+		// assert ...
+		assertStmt, err := parser.consumeAssert(varMap)
+		if err == nil {
+			function.AppendStatement(assertStmt)
+			continue
+		}
+
+		// try ...
+		tryStmt, err := parser.consumeTry(varMap)
+		if err == nil {
+			function.AppendStatement(tryStmt)
+			continue
+		}
+
 		// TODO: yes/no cannot be used outside of questions
 		sentenceOrAnswer, err :=
-			parser.consumeSentenceCallOrAnswerCall(function.VariableMap())
+			parser.consumeSentenceCallOrAnswerCall(varMap)
 		if err == nil {
 			function.AppendStatement(sentenceOrAnswer)
 			continue
@@ -504,6 +608,30 @@ func (parser *Parser) consumeFunction() (function *Function, err error) {
 	return function, nil
 }
 
+// variableMap contains all of the variables and constants that can be
+// referenced from within the function. Local variables and arguments take
+// precedence over the file-level variables of the same name.
+func (parser *Parser) variableMap(function *Function) map[string]*VariableDefinition {
+	m := parser.program.VariableMap()
+
+	if parser.program.UsesTry {
+		m = parser.withErrorVariables(m)
+	}
+
+	for _, constant := range parser.program.Constants {
+		m[constant.Name] = &VariableDefinition{
+			Name: constant.Name,
+			Type: constant.Type(),
+		}
+	}
+
+	for name, variable := range function.VariableMap() {
+		m[name] = variable
+	}
+
+	return m
+}
+
 func (parser *Parser) consumeFunctionDeclaration() (function *Function, err error) {
 	originalOffset := parser.offset
 	defer func() {
@@ -534,14 +662,31 @@ func (parser *Parser) consumeFunctionDeclaration() (function *Function, err erro
 			return nil, err
 		}
 
+		varMap := map[string]*VariableDefinition{}
+		for _, definition := range vars {
+			varMap[definition.Name] = definition
+		}
+
 		for i, word := range function.Definition.Words {
-			if ty, ok := vars[word.(string)]; ok {
+			if definition, ok := varMap[word.(string)]; ok {
 				function.Definition.Words[i] = VariableReference(word.(string))
 
 				// Note: It's important that we add the arguments in the order
 				// that they appear rather than the order that they are defined.
 				// Appending them in this loop will ensure that.
-				function.AppendArgument(word.(string), ty.Type)
+				function.AppendArgument(definition)
+				delete(varMap, definition.Name)
+			}
+		}
+
+		// The start function has no placeholders. Instead, its arguments are
+		// provided on the command line so they are kept in the order they are
+		// defined.
+		if function.Definition.Syntax() == "start" {
+			for _, definition := range vars {
+				if _, ok := varMap[definition.Name]; ok {
+					function.AppendArgument(definition)
+				}
 			}
 		}
 	}
@@ -596,6 +741,54 @@ func (parser *Parser) consumeDeclare() (definition *VariableDefinition, err erro
 	return
 }
 
+// Examples:
+//
+//   define tax-rate as 0.15
+//   define sales-inbox as "sales@example.com"
+//
+func (parser *Parser) consumeDefine() (constant *ConstantDefinition, err error) {
+	originalOffset := parser.offset
+	defer func() {
+		if err != nil {
+			parser.offset = originalOffset
+		}
+	}()
+
+	_, err = parser.consumeSpecificWord(WordDefine)
+	if err != nil {
+		return
+	}
+
+	constant = new(ConstantDefinition)
+
+	constant.Name, err = parser.consumeWord()
+	if err != nil {
+		return
+	}
+
+	_, err = parser.consumeSpecificWord("as")
+	if err != nil {
+		return
+	}
+
+	constant.Value, err = parser.consumeSentenceWord(nil)
+	if err != nil {
+		return
+	}
+
+	if _, ok := constant.Value.(string); ok {
+		err = fmt.Errorf("constant %s must be text or a number", constant.Name)
+		return
+	}
+
+	_, err = parser.consumeToken(TokenKindEndOfLine)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
 func (parser *Parser) consumeIf(varMap map[string]*VariableDefinition) (ifStmt *If, err error) {
 	originalOffset := parser.offset
 	defer func() {
@@ -767,3 +960,241 @@ func (parser *Parser) consumeWhile(varMap map[string]*VariableDefinition) (while
 
 	return
 }
+
+// Examples:
+//
+//   for each line in file "customers.txt", display line
+//   for each path matching "reports/*.csv", delete file path
+//
+func (parser *Parser) consumeForEach(varMap map[string]*VariableDefinition) (forEach *ForEach, err error) {
+	originalOffset := parser.offset
+	defer func() {
+		if err != nil {
+			parser.offset = originalOffset
+		}
+	}()
+
+	_, err = parser.consumeSpecificWord(WordFor)
+	if err != nil {
+		return
+	}
+
+	_, err = parser.consumeSpecificWord(WordEach)
+	if err != nil {
+		return
+	}
+
+	forEach = &ForEach{}
+
+	variable, err := parser.consumeSentenceWord(varMap)
+	if err != nil {
+		return
+	}
+
+	var ok bool
+	forEach.Variable, ok = variable.(VariableReference)
+	if !ok {
+		return nil, fmt.Errorf("expected variable after for each, but got %v",
+			variable)
+	}
+
+	forEach.Source, err = parser.consumeSentence(varMap)
+	if err != nil {
+		return
+	}
+
+	err = parser.consumeComma()
+	if err != nil {
+		return
+	}
+
+	forEach.Body, err = parser.consumeSentence(varMap)
+	if err != nil {
+		return
+	}
+
+	_, err = parser.consumeToken(TokenKindEndOfLine)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// Examples:
+//
+//   try send invoices, on failure display "could not send: " error
+//   try import customers, finally delete file "customers.tmp"
+//   try import customers, on failure display error, finally display "done"
+//
+func (parser *Parser) consumeTry(varMap map[string]*VariableDefinition) (tryStmt *Try, err error) {
+	originalOffset := parser.offset
+	defer func() {
+		if err != nil {
+			parser.offset = originalOffset
+		}
+	}()
+
+	_, err = parser.consumeSpecificWord(WordTry)
+	if err != nil {
+		return
+	}
+
+	tryStmt = &Try{}
+
+	tryStmt.Try, err = parser.consumeNonEmptySentence(varMap)
+	if err != nil {
+		return
+	}
+
+	err = parser.consumeComma()
+	if err != nil {
+		return
+	}
+
+	// The details of the failure can be used in the sentences that follow.
+	varMap = parser.withErrorVariables(varMap)
+
+	if parser.consumeOnFailure() == nil {
+		tryStmt.OnFailure, err = parser.consumeNonEmptySentence(varMap)
+		if err != nil {
+			return
+		}
+
+		// The "finally" is optional when there is an "on failure".
+		if parser.consumeComma() == nil {
+			tryStmt.Finally, err = parser.consumeFinally(varMap)
+		}
+	} else {
+		tryStmt.Finally, err = parser.consumeFinally(varMap)
+	}
+
+	if err != nil {
+		return
+	}
+
+	_, err = parser.consumeToken(TokenKindEndOfLine)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+// usesTry is true if any statement starts with "try". It has to be known
+// before the functions are parsed, so that the error variables can also be
+// used in functions that are above the first "try".
+func (parser *Parser) usesTry() bool {
+	for i := 1; i < len(parser.tokens); i++ {
+		previous, token := parser.tokens[i-1], parser.tokens[i]
+		isStatementStart := previous.Kind == TokenKindEndOfLine ||
+			previous.Kind == TokenKindColon
+
+		if isStatementStart && token.Kind == TokenKindWord &&
+			token.Value == WordTry {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (parser *Parser) consumeOnFailure() (err error) {
+	originalOffset := parser.offset
+	defer func() {
+		if err != nil {
+			parser.offset = originalOffset
+		}
+	}()
+
+	_, err = parser.consumeSpecificWord(WordOn)
+	if err != nil {
+		return
+	}
+
+	_, err = parser.consumeSpecificWord(WordFailure)
+
+	return
+}
+
+func (parser *Parser) consumeFinally(varMap map[string]*VariableDefinition) (sentence *Sentence, err error) {
+	originalOffset := parser.offset
+	defer func() {
+		if err != nil {
+			parser.offset = originalOffset
+		}
+	}()
+
+	_, err = parser.consumeSpecificWord(WordFinally)
+	if err != nil {
+		return
+	}
+
+	return parser.consumeNonEmptySentence(varMap)
+}
+
+func (parser *Parser) consumeNonEmptySentence(varMap map[string]*VariableDefinition) (*Sentence, error) {
+	sentence, err := parser.consumeSentence(varMap)
+	if err == nil && len(sentence.Words) == 0 {
+		err = errors.New("expected sentence")
+	}
+
+	return sentence, err
+}
+
+// withErrorVariables returns a copy of varMap that also contains the variables
+// describing a failure. Existing variables with the same name are kept.
+func (parser *Parser) withErrorVariables(varMap map[string]*VariableDefinition) map[string]*VariableDefinition {
+	m := map[string]*VariableDefinition{}
+	for name, definition := range varMap {
+		m[name] = definition
+	}
+
+	for _, name := range errorVariables {
+		if _, ok := m[name]; !ok {
+			m[name] = &VariableDefinition{
+				Name: name,
+				Type: VariableTypeText,
+			}
+		}
+	}
+
+	return m
+}
+
+// Examples:
+//
+//   assert total > 0
+//   assert file "report.csv" exists
+//
+func (parser *Parser) consumeAssert(varMap map[string]*VariableDefinition) (assertStmt *Assert, err error) {
+	originalOffset := parser.offset
+	defer func() {
+		if err != nil {
+			parser.offset = originalOffset
+		}
+	}()
+
+	_, err = parser.consumeSpecificWord(WordAssert)
+	if err != nil {
+		return
+	}
+
+	assertStmt = &Assert{}
+
+	assertStmt.Condition, err = parser.consumeCondition(varMap)
+	if err != nil {
+		// It must be a question instead of a condition.
+		assertStmt.Question, err = parser.consumeNonEmptySentence(varMap)
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = parser.consumeToken(TokenKindEndOfLine)
+	if err != nil {
+		return
+	}
+
+	return
+}
@@ -126,6 +126,242 @@ var parserTests = map[string]struct {
 			},
 		},
 	},
+	"FileVariable": {
+		bento: "declare foo is text\nstart: display foo",
+		expected: &Program{
+			Functions: map[string]*Function{
+				"start": {
+					Definition: &Sentence{Words: []interface{}{"start"}},
+					Statements: []Statement{
+						&Sentence{
+							Words: []interface{}{
+								"display", VariableReference("foo"),
+							},
+						},
+					},
+				},
+			},
+			Variables: []*VariableDefinition{
+				{
+					Name: "foo",
+					Type: "text",
+				},
+			},
+		},
+	},
+	"Constants": {
+		bento: "define rate as 0.15\ndefine inbox as \"sales@example.com\"\n" +
+			"start: display inbox rate",
+		expected: &Program{
+			Functions: map[string]*Function{
+				"start": {
+					Definition: &Sentence{Words: []interface{}{"start"}},
+					Statements: []Statement{
+						&Sentence{
+							Words: []interface{}{
+								"display", VariableReference("inbox"),
+								VariableReference("rate"),
+							},
+						},
+					},
+				},
+			},
+			Constants: []*ConstantDefinition{
+				{
+					Name:  "rate",
+					Value: NewNumber("0.15", UnlimitedPrecision),
+				},
+				{
+					Name:  "inbox",
+					Value: NewText("sales@example.com"),
+				},
+			},
+		},
+	},
+	"StartArguments": {
+		bento: "start (days is number, customer is text): display days",
+		expected: &Program{
+			Functions: map[string]*Function{
+				"start": {
+					Definition: &Sentence{Words: []interface{}{"start"}},
+					Variables: []*VariableDefinition{
+						{
+							Name:      "days",
+							Type:      "number",
+							Precision: 6,
+						},
+						{
+							Name: "customer",
+							Type: "text",
+						},
+					},
+					Statements: []Statement{
+						&Sentence{
+							Words: []interface{}{
+								"display", VariableReference("days"),
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+	"CommaSeparatedValues": {
+		bento: "start: choose one of \"a\", \"b\",\n  3 into _",
+		expected: &Program{
+			Functions: map[string]*Function{
+				"start": {
+					Definition: &Sentence{Words: []interface{}{"start"}},
+					Statements: []Statement{
+						&Sentence{
+							Words: []interface{}{
+								"choose", "one", "of", NewText("a"),
+								NewText("b"), NewNumber("3", 6), "into",
+								VariableReference("_"),
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+	"CommaSeparatedRow": {
+		bento: "start: declare row is text\nwrite row \"a\", 1 to csv out",
+		expected: &Program{
+			Functions: map[string]*Function{
+				"start": {
+					Definition: &Sentence{Words: []interface{}{"start"}},
+					Variables: []*VariableDefinition{
+						{
+							Name:       "row",
+							Type:       "text",
+							LocalScope: true,
+						},
+					},
+					Statements: []Statement{
+						&Sentence{
+							Words: []interface{}{
+								"write", VariableReference("row"),
+								NewText("a"), NewNumber("1", 6), "to", "csv",
+								"out",
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+	"ForEach": {
+		bento: "start: declare line is text\n" +
+			"for each line in file \"a.txt\", display line",
+		expected: &Program{
+			Functions: map[string]*Function{
+				"start": {
+					Definition: &Sentence{Words: []interface{}{"start"}},
+					Variables: []*VariableDefinition{
+						{
+							Name:       "line",
+							Type:       "text",
+							LocalScope: true,
+						},
+					},
+					Statements: []Statement{
+						&ForEach{
+							Variable: VariableReference("line"),
+							Source: &Sentence{
+								Words: []interface{}{
+									"in", "file", NewText("a.txt"),
+								},
+							},
+							Body: &Sentence{
+								Words: []interface{}{
+									"display", VariableReference("line"),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+	"Try": {
+		bento: "start:\ntry send invoices, on failure display error, " +
+			"finally display \"done\"",
+		expected: &Program{
+			UsesTry: true,
+			Functions: map[string]*Function{
+				"start": {
+					Definition: &Sentence{Words: []interface{}{"start"}},
+					Statements: []Statement{
+						&Try{
+							Try: &Sentence{
+								Words: []interface{}{"send", "invoices"},
+							},
+							OnFailure: &Sentence{
+								Words: []interface{}{
+									"display", VariableReference("error"),
+								},
+							},
+							Finally: &Sentence{
+								Words: []interface{}{
+									"display", NewText("done"),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+	"Assert": {
+		bento: "start:\nassert 1 > 0\nassert file \"a.txt\" exists",
+		expected: &Program{
+			Functions: map[string]*Function{
+				"start": {
+					Definition: &Sentence{Words: []interface{}{"start"}},
+					Statements: []Statement{
+						&Assert{
+							Condition: &Condition{
+								Left:     NewNumber("1", 0),
+								Operator: ">",
+								Right:    NewNumber("0", 0),
+							},
+						},
+						&Assert{
+							Question: &Sentence{
+								Words: []interface{}{
+									"file", NewText("a.txt"), "exists",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
+	"TryFinally": {
+		bento: "start:\ntry send invoices, finally display \"done\"",
+		expected: &Program{
+			UsesTry: true,
+			Functions: map[string]*Function{
+				"start": {
+					Definition: &Sentence{Words: []interface{}{"start"}},
+					Statements: []Statement{
+						&Try{
+							Try: &Sentence{
+								Words: []interface{}{"send", "invoices"},
+							},
+							Finally: &Sentence{
+								Words: []interface{}{
+									"display", NewText("done"),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	},
 	"Function1": {
 		bento: "start:  display \"hi\"\ndo something:\ndisplay \"ok\"",
 		expected: &Program{
@@ -903,3 +1139,11 @@ func TestParser_Parse(t *testing.T) {
 		})
 	}
 }
+
+// Only the ListSentences can have values separated by commas.
+func TestParser_CommaEndsSentence(t *testing.T) {
+	parser := NewParser(strings.NewReader("start: display \"a\", \"b\""))
+	_, err := parser.Parse()
+
+	assert.EqualError(t, err, "expected :, but got ,")
+}
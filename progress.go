@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// progressDisplay shows the progress and output that a backend sends while a
+// sentence is running. On a terminal the progress is a single line that is
+// redrawn each time it changes. Otherwise, such as when the output is
+// redirected to a file, each message is written on its own line.
+type progressDisplay struct {
+	out      io.Writer
+	terminal bool
+
+	// line is the progress line that is currently shown on the terminal. It
+	// is empty if there is no progress line.
+	line string
+}
+
+// clearLine moves to the start of the line and erases it.
+const clearLine = "\r\x1b[K"
+
+func (display *progressDisplay) progress(progress float64, message string) {
+	// Backends may not be precise, but a percentage outside of 0-100 is
+	// never useful.
+	percent := fmt.Sprintf("%.0f%%", 100*math.Max(0, math.Min(1, progress)))
+
+	line := percent
+	if message != "" {
+		line = message + " " + percent
+	}
+
+	if !display.terminal {
+		_, _ = fmt.Fprintln(display.out, line)
+
+		return
+	}
+
+	display.line = line
+	_, _ = fmt.Fprint(display.out, clearLine+line)
+}
+
+// output is written above the progress line, which stays at the bottom.
+func (display *progressDisplay) output(output string) {
+	if display.line == "" {
+		_, _ = fmt.Fprintln(display.out, output)
+
+		return
+	}
+
+	_, _ = fmt.Fprint(display.out, clearLine+output+"\n"+display.line)
+}
+
+// finish removes the progress line when the sentence is done, so that it does
+// not get mixed up with what is written after it.
+func (display *progressDisplay) finish() {
+	if display.line != "" {
+		_, _ = fmt.Fprint(display.out, clearLine)
+		display.line = ""
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var progressDisplayTests = map[string]struct {
+	terminal bool
+	expected string
+}{
+	"Redirected": {
+		expected: "Exporting 0%\nfirst\n42%\nsecond\nDone 100%\n",
+	},
+	"Terminal": {
+		terminal: true,
+		expected: "\r\x1b[KExporting 0%" + "\r\x1b[Kfirst\nExporting 0%" +
+			"\r\x1b[K42%" + "\r\x1b[Ksecond\n42%" + "\r\x1b[KDone 100%" +
+			"\r\x1b[K",
+	},
+}
+
+func TestProgressDisplay(t *testing.T) {
+	for testName, test := range progressDisplayTests {
+		t.Run(testName, func(t *testing.T) {
+			out := bytes.NewBuffer(nil)
+			display := &progressDisplay{out: out, terminal: test.terminal}
+
+			display.progress(-0.1, "Exporting")
+			display.output("first")
+			display.progress(0.4213, "")
+			display.output("second")
+			display.progress(1.5, "Done")
+			display.finish()
+			display.finish()
+
+			assert.Equal(t, test.expected, out.String())
+		})
+	}
+}
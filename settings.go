@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadSettings reads a settings file. The format is chosen by the file
+// extension:
+//
+//   .ini           INI file with optional [sections]
+//   .yaml or .yml  Simple YAML containing only keys and values
+//   (anything)     .env file with KEY=VALUE on each line
+//
+// The names of the settings are returned in the same form as variable names.
+// That is, "REPORT_DB" becomes "report-db". Sections (for INI) and nested keys
+// (for YAML) are joined with a "-", so "[database] name" is "database-name".
+func ReadSettings(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var settings map[string]string
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ini":
+		settings, err = readINISettings(file)
+
+	case ".yaml", ".yml":
+		settings, err = readYAMLSettings(file)
+
+	default:
+		settings, err = readEnvSettings(file)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%s:%v", path, err)
+	}
+
+	return settings, nil
+}
+
+// settingName converts a key into the form of a variable name.
+func settingName(parts ...string) string {
+	name := strings.Join(parts, "-")
+	name = strings.Replace(name, "_", "-", -1)
+	name = strings.Replace(name, " ", "-", -1)
+
+	return strings.ToLower(name)
+}
+
+// settingValue removes quotes and trailing comments from a value.
+func settingValue(value string) string {
+	value = strings.TrimSpace(value)
+
+	if len(value) >= 2 {
+		switch {
+		case value[0] == '"' && value[len(value)-1] == '"':
+			return strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).
+				Replace(value[1 : len(value)-1])
+
+		case value[0] == '\'' && value[len(value)-1] == '\'':
+			return value[1 : len(value)-1]
+		}
+	}
+
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+
+	return value
+}
+
+// settingLines calls fn with each line that is not empty or a comment. The
+// line number starts from 1.
+func settingLines(r io.Reader, fn func(lineNumber int, line string) error) error {
+	scanner := bufio.NewScanner(r)
+
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		trimmed := strings.TrimSpace(line)
+
+		if trimmed == "" || trimmed[0] == '#' || trimmed[0] == ';' {
+			continue
+		}
+
+		if err := fn(lineNumber, line); err != nil {
+			return fmt.Errorf("%d: %v", lineNumber, err)
+		}
+	}
+
+	return scanner.Err()
+}
+
+func readEnvSettings(r io.Reader) (map[string]string, error) {
+	settings := map[string]string{}
+
+	err := settingLines(r, func(lineNumber int, line string) error {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "export ")
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("expected KEY=VALUE, but got %q", line)
+		}
+
+		settings[settingName(strings.TrimSpace(parts[0]))] =
+			settingValue(parts[1])
+
+		return nil
+	})
+
+	return settings, err
+}
+
+func readINISettings(r io.Reader) (map[string]string, error) {
+	settings := map[string]string{}
+	var section []string
+
+	err := settingLines(r, func(lineNumber int, line string) error {
+		line = strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = []string{strings.TrimSpace(line[1 : len(line)-1])}
+			return nil
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("expected key = value, but got %q", line)
+		}
+
+		name := append(section, strings.TrimSpace(parts[0]))
+		settings[settingName(name...)] = settingValue(parts[1])
+
+		return nil
+	})
+
+	return settings, err
+}
+
+// readYAMLSettings only supports the simplest form of YAML. That is, keys with
+// text or number values which may be nested by indentation.
+func readYAMLSettings(r io.Reader) (map[string]string, error) {
+	settings := map[string]string{}
+
+	// Each of the parent keys and their indentation.
+	var keys []string
+	var indents []int
+
+	err := settingLines(r, func(lineNumber int, line string) error {
+		trimmed := strings.TrimLeft(line, " ")
+		indent := len(line) - len(trimmed)
+
+		if trimmed == "---" {
+			return nil
+		}
+
+		if strings.HasPrefix(trimmed, "- ") || strings.Contains(line, "\t") {
+			return fmt.Errorf("only keys and values are supported, "+
+				"but got %q", trimmed)
+		}
+
+		parts := strings.SplitN(trimmed, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("expected key: value, but got %q", trimmed)
+		}
+
+		for len(indents) > 0 && indents[len(indents)-1] >= indent {
+			keys = keys[:len(keys)-1]
+			indents = indents[:len(indents)-1]
+		}
+
+		key := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+
+		// A key without a value contains nested keys.
+		if value == "" {
+			keys = append(keys, key)
+			indents = append(indents, indent)
+			return nil
+		}
+
+		settings[settingName(append(keys, key)...)] = settingValue(value)
+
+		return nil
+	})
+
+	return settings, err
+}
+
+func environmentVariable(vm *VirtualMachine, args []int) error {
+	name := valueString(vm.GetArg(args[0]))
+
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		if len(args) < 3 {
+			return fmt.Errorf("environment variable %s is not set", name)
+		}
+
+		value = valueString(vm.GetArg(args[2]))
+	}
+
+	err := vm.SetArgText(args[1], value)
+	if err != nil {
+		return fmt.Errorf("environment variable %s: %v", name, err)
+	}
+
+	return nil
+}
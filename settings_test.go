@@ -0,0 +1,82 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+var settingsTests = map[string]struct {
+	read     func(string) (map[string]string, error)
+	data     string
+	expected map[string]string
+	err      string
+}{
+	"Env": {
+		read: func(s string) (map[string]string, error) {
+			return readEnvSettings(strings.NewReader(s))
+		},
+		data: "# Comment\nREPORT_DB=sales\nexport DAYS = 7 # a week\n" +
+			"NAME=\"Bob \\\"B\\\" Smith\"\nRAW='a # b'\n",
+		expected: map[string]string{
+			"report-db": "sales",
+			"days":      "7",
+			"name":      `Bob "B" Smith`,
+			"raw":       "a # b",
+		},
+	},
+	"EnvBadLine": {
+		read: func(s string) (map[string]string, error) {
+			return readEnvSettings(strings.NewReader(s))
+		},
+		data: "A=1\n\nfoo\n",
+		err:  `3: expected KEY=VALUE, but got "foo"`,
+	},
+	"INI": {
+		read: func(s string) (map[string]string, error) {
+			return readINISettings(strings.NewReader(s))
+		},
+		data: "; Comment\nname = top\n[database]\nname = sales\nport=3306\n",
+		expected: map[string]string{
+			"name":          "top",
+			"database-name": "sales",
+			"database-port": "3306",
+		},
+	},
+	"YAML": {
+		read: func(s string) (map[string]string, error) {
+			return readYAMLSettings(strings.NewReader(s))
+		},
+		data: "---\nname: top\ndatabase:\n  name: \"sales\"\n  " +
+			"connection:\n    port: 3306\nreport_days: 7\n",
+		expected: map[string]string{
+			"name":                     "top",
+			"database-name":            "sales",
+			"database-connection-port": "3306",
+			"report-days":              "7",
+		},
+	},
+	"YAMLList": {
+		read: func(s string) (map[string]string, error) {
+			return readYAMLSettings(strings.NewReader(s))
+		},
+		data: "names:\n  - bob\n",
+		err:  `2: only keys and values are supported, but got "- bob"`,
+	},
+}
+
+func TestReadSettings(t *testing.T) {
+	for testName, test := range settingsTests {
+		t.Run(testName, func(t *testing.T) {
+			settings, err := test.read(test.data)
+
+			if test.err != "" {
+				assert.EqualError(t, err, test.err)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, test.expected, settings)
+			}
+		})
+	}
+}
@@ -8,7 +8,7 @@ import (
 )
 
 // System defines all of the inbuilt functions.
-var System = map[string]func(vm *VirtualMachine, args []int){
+var System = map[string]func(vm *VirtualMachine, args []int) error{
 	// This is a really dodgy hack until we can properly support varargs. Each
 	// of the arguments will be printed with no space between them and a single
 	// newline will be written after any (including zero) arguments.
@@ -34,9 +34,127 @@ var System = map[string]func(vm *VirtualMachine, args []int){
 	"run system command ? output into ?":                    systemOutput,
 	"run system command ? status code into ?":               systemStatus,
 	"run system command ? output into ? status code into ?": systemOutputStatus,
+
+	// Stopping the program. The message is written to stderr.
+	"stop":                             stop,
+	"stop with status ?":               stopWithStatus,
+	"stop with message ?":              stopWithMessage,
+	"stop with status ? and message ?": stopWithStatusAndMessage,
+
+	// Questions about the failure handled by the most recent "try".
+	"failure is retryable": failureIsRetryable,
+
+	// Files. Relative paths are relative to the program.
+	"read file ? into ?": readFile,
+	"write ? to file ?":  writeFile,
+	"append ? to file ?": appendFile,
+	"delete file ?":      deleteFile,
+	"copy file ? to ?":   copyFile,
+	"move file ? to ?":   moveFile,
+	"file ? exists":      fileExists,
+
+	// HTTP requests. The options apply to all requests that come after them.
+	"fetch ? into ?":                        fetch,
+	"fetch ? into ? status code into ?":     fetch,
+	"post ? to ? into ?":                    post,
+	"post ? to ? into ? status code into ?": post,
+	"use header ? with value ?":             useHeader,
+	"use bearer token ?":                    useBearerToken,
+	"use basic auth ? with password ?":      useBasicAuth,
+	"use request timeout of ? seconds":      useRequestTimeout,
+
+	// CSV files. Like display, "write row" needs a separate sentence for each
+	// number of values.
+	"open csv file ? into ?":                 openCSV,
+	"open csv file ? with header into ?":     openCSVWithHeader,
+	"open csv file ? without header into ?":  openCSVWithoutHeader,
+	"create csv file ? into ?":               createCSV,
+	"use delimiter ? for ?":                  useCSVDelimiter,
+	"quote every field in ?":                 quoteEveryCSVField,
+	"display column ? of ?":                  displayCSVColumn,
+	"read column ? of ? into ?":              readCSVColumn,
+	"write row ? to csv ?":                   writeCSVRow,
+	"write row ? ? to csv ?":                 writeCSVRow,
+	"write row ? ? ? to csv ?":               writeCSVRow,
+	"write row ? ? ? ? to csv ?":             writeCSVRow,
+	"write row ? ? ? ? ? to csv ?":           writeCSVRow,
+	"write row ? ? ? ? ? ? to csv ?":         writeCSVRow,
+	"write row ? ? ? ? ? ? ? to csv ?":       writeCSVRow,
+	"write row ? ? ? ? ? ? ? ? to csv ?":     writeCSVRow,
+	"write row ? ? ? ? ? ? ? ? ? to csv ?":   writeCSVRow,
+	"write row ? ? ? ? ? ? ? ? ? ? to csv ?": writeCSVRow,
+
+	// JSON. Any of the sentences that read from json will also accept text
+	// containing JSON.
+	"read field ? of ? into ?":           readJSONField,
+	"read length of ? into ?":            readJSONLength,
+	"read length of field ? of ? into ?": readJSONFieldLength,
+	"field ? exists in ?":                jsonFieldExists,
+	"set field ? of ? to ?":              setJSONFieldSentence,
+
+	// Reading configuration. "load settings from ?" and "load required
+	// settings from ?" are not here because they have to be compiled into a
+	// LoadSettingsInstruction.
+	"read environment variable ? into ?":                environmentVariable,
+	"read environment variable ? into ? with default ?": environmentVariable,
+
+	// Reading input from the person running the program.
+	"ask ? into ?": ask,
+	"confirm ?":    confirm,
+
+	// Like display, choose needs a separate sentence for each number of
+	// options.
+	"choose one of ? ? into ?":                 choose,
+	"choose one of ? ? ? into ?":               choose,
+	"choose one of ? ? ? ? into ?":             choose,
+	"choose one of ? ? ? ? ? into ?":           choose,
+	"choose one of ? ? ? ? ? ? into ?":         choose,
+	"choose one of ? ? ? ? ? ? ? into ?":       choose,
+	"choose one of ? ? ? ? ? ? ? ? into ?":     choose,
+	"choose one of ? ? ? ? ? ? ? ? ? into ?":   choose,
+	"choose one of ? ? ? ? ? ? ? ? ? ? into ?": choose,
+}
+
+// SystemDestinations are the placeholders (starting from 0) that each of the
+// inbuilt functions will write to. These can never be constants.
+var SystemDestinations = map[string][]int{
+	"set ? to ?":                                            {0},
+	"add ? and ? into ?":                                    {2},
+	"subtract ? from ? into ?":                              {2},
+	"multiply ? and ? into ?":                               {2},
+	"divide ? by ? into ?":                                  {2},
+	"run system command ? output into ?":                    {1},
+	"run system command ? status code into ?":               {1},
+	"run system command ? output into ? status code into ?": {1, 2},
+	"ask ? into ?":                                          {1},
+	"read file ? into ?":                                    {1},
+	"fetch ? into ?":                                        {1},
+	"fetch ? into ? status code into ?":                     {1, 2},
+	"post ? to ? into ?":                                    {2},
+	"post ? to ? into ? status code into ?":                 {2, 3},
+	"open csv file ? into ?":                                {1},
+	"open csv file ? with header into ?":                    {1},
+	"open csv file ? without header into ?":                 {1},
+	"create csv file ? into ?":                              {1},
+	"read column ? of ? into ?":                             {2},
+	"read field ? of ? into ?":                              {2},
+	"read length of ? into ?":                               {1},
+	"read length of field ? of ? into ?":                    {2},
+	"set field ? of ? to ?":                                 {1},
+	"read environment variable ? into ?":                    {1},
+	"read environment variable ? into ? with default ?":     {1},
+	"choose one of ? ? into ?":                              {2},
+	"choose one of ? ? ? into ?":                            {3},
+	"choose one of ? ? ? ? into ?":                          {4},
+	"choose one of ? ? ? ? ? into ?":                        {5},
+	"choose one of ? ? ? ? ? ? into ?":                      {6},
+	"choose one of ? ? ? ? ? ? ? into ?":                    {7},
+	"choose one of ? ? ? ? ? ? ? ? into ?":                  {8},
+	"choose one of ? ? ? ? ? ? ? ? ? into ?":                {9},
+	"choose one of ? ? ? ? ? ? ? ? ? ? into ?":              {10},
 }
 
-func display(vm *VirtualMachine, args []int) {
+func display(vm *VirtualMachine, args []int) error {
 	for _, arg := range args {
 		// TODO: Convert this switch into an interface.
 		switch value := vm.GetArg(arg).(type) {
@@ -48,13 +166,32 @@ func display(vm *VirtualMachine, args []int) {
 
 		case nil: // blackhole
 
-		case *Backend:
-			response, err := value.send(&BackendRequest{
+		case *CSVFile:
+			_, _ = fmt.Fprintf(vm.out, "%v", value.String())
+
+		case *JSONValue:
+			_, _ = fmt.Fprintf(vm.out, "%v", value.String())
+
+		case *CSVRow:
+			_, _ = fmt.Fprintf(vm.out, "%v", value.String())
+
+		case *BackendInstance:
+			err := vm.createInstances([]*BackendInstance{value})
+			if err != nil {
+				return err
+			}
+
+			// The backend cannot run callbacks while it displays a value.
+			response, err := vm.sendToBackend(value.backend, &BackendRequest{
 				Sentence: "display ?",
-				Args:     []string{fmt.Sprintf("%v", value)},
-			})
+				Args:     []interface{}{value.String()},
+			}, nil)
 			if err != nil {
-				panic(err)
+				return err
+			}
+
+			if response.failed() {
+				return response.Error
 			}
 
 			_, _ = fmt.Fprintf(vm.out, "%v", response.Text)
@@ -65,26 +202,75 @@ func display(vm *VirtualMachine, args []int) {
 	}
 
 	_, _ = fmt.Fprint(vm.out, "\n")
+
+	return nil
 }
 
-func setVariable(vm *VirtualMachine, args []int) {
+// valueString is the text representation of a text or number value.
+func valueString(value interface{}) string {
+	switch v := value.(type) {
+	case *string:
+		return *v
+
+	case *Number:
+		return v.String()
+
+	case nil:
+		return ""
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+func setVariable(vm *VirtualMachine, args []int) error {
+	// Text and numbers can be put into json, and json can be turned back into
+	// text.
+	if _, ok := vm.GetArg(args[0]).(*JSONValue); ok {
+		if text, ok := vm.GetArg(args[1]).(*string); ok {
+			value, err := ParseJSON(*text)
+			if err != nil {
+				return err
+			}
+
+			vm.SetArg(args[0], value)
+
+			return nil
+		}
+
+		value, err := vm.newJSONFieldValue(args[1])
+		if err != nil {
+			return err
+		}
+
+		vm.SetArg(args[0], &JSONValue{Value: value})
+
+		return nil
+	}
+
 	switch value := vm.GetArg(args[1]).(type) {
 	case *string: // text
 		vm.SetArg(args[0], NewText(*value))
 
 	case *Number:
 		vm.GetNumber(args[0]).Set(value)
+
+	case *JSONValue:
+		return vm.SetArgJSON(args[0], value.Value)
 	}
+
+	return nil
 }
 
-func add(vm *VirtualMachine, args []int) {
+func add(vm *VirtualMachine, args []int) error {
 	a := vm.GetNumber(args[0])
 	b := vm.GetNumber(args[1])
 	c := vm.GetNumber(args[2])
 	c.Add(a, b)
+
+	return nil
 }
 
-func subtract(vm *VirtualMachine, args []int) {
+func subtract(vm *VirtualMachine, args []int) error {
 	a := vm.GetNumber(args[0])
 	b := vm.GetNumber(args[1])
 	c := vm.GetNumber(args[2])
@@ -92,55 +278,85 @@ func subtract(vm *VirtualMachine, args []int) {
 	// Notice there are in reverse order because the language is
 	// "subtract a from b".
 	c.Sub(b, a)
+
+	return nil
 }
 
-func multiply(vm *VirtualMachine, args []int) {
+func multiply(vm *VirtualMachine, args []int) error {
 	a := vm.GetNumber(args[0])
 	b := vm.GetNumber(args[1])
 	c := vm.GetNumber(args[2])
 	c.Mul(a, b)
+
+	return nil
 }
 
-func divide(vm *VirtualMachine, args []int) {
+func divide(vm *VirtualMachine, args []int) error {
 	a := vm.GetNumber(args[0])
 	b := vm.GetNumber(args[1])
 	c := vm.GetNumber(args[2])
 	c.Quo(a, b)
+
+	return nil
 }
 
-func runSystemCommand(rawCommand string) (output []byte, status int) {
+// runSystemCommand only returns an error if the command could not be run at
+// all. A non-zero exit status is not an error.
+func runSystemCommand(rawCommand string) (output []byte, status int, err error) {
 	cmd := exec.Command("sh", "-c", rawCommand)
-	var err error
 	output, err = cmd.CombinedOutput()
 
 	if msg, ok := err.(*exec.ExitError); ok {
 		status = msg.Sys().(syscall.WaitStatus).ExitStatus()
+		err = nil
 	}
 
 	return
 }
 
-func system(vm *VirtualMachine, args []int) {
+// systemCommandFailed is used when the status code is not being put into a
+// variable, so a non-zero status must be an error.
+func systemCommandFailed(rawCommand string, status int, err error) error {
+	if err != nil {
+		return err
+	}
+
+	if status != 0 {
+		return &SystemCommandError{Command: rawCommand, Status: status}
+	}
+
+	return nil
+}
+
+func system(vm *VirtualMachine, args []int) error {
 	rawCommand := vm.GetText(args[0])
-	output, _ := runSystemCommand(*rawCommand)
+	output, status, err := runSystemCommand(*rawCommand)
 	_, _ = vm.out.Write(output)
+
+	return systemCommandFailed(*rawCommand, status, err)
 }
 
-func systemOutput(vm *VirtualMachine, args []int) {
+func systemOutput(vm *VirtualMachine, args []int) error {
 	rawCommand := vm.GetText(args[0])
-	output, _ := runSystemCommand(*rawCommand)
+	output, status, err := runSystemCommand(*rawCommand)
 	vm.SetArg(args[1], NewText(string(output)))
+
+	return systemCommandFailed(*rawCommand, status, err)
 }
 
-func systemStatus(vm *VirtualMachine, args []int) {
+func systemStatus(vm *VirtualMachine, args []int) error {
 	rawCommand := vm.GetText(args[0])
-	_, status := runSystemCommand(*rawCommand)
+	_, status, err := runSystemCommand(*rawCommand)
 	vm.SetArg(args[1], NewNumber(strconv.Itoa(status), 0))
+
+	return err
 }
 
-func systemOutputStatus(vm *VirtualMachine, args []int) {
+func systemOutputStatus(vm *VirtualMachine, args []int) error {
 	rawCommand := vm.GetText(args[0])
-	output, status := runSystemCommand(*rawCommand)
+	output, status, err := runSystemCommand(*rawCommand)
 	vm.SetArg(args[1], NewText(string(output)))
 	vm.SetArg(args[2], NewNumber(strconv.Itoa(status), 0))
+
+	return err
 }
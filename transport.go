@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// The transports that can be used in the bento.json.
+const (
+	TransportTCP   = "tcp"
+	TransportStdio = "stdio"
+	TransportUnix  = "unix"
+)
+
+// transport is how the requests and responses are exchanged with a backend.
+// Each message is always a single line of JSON, no matter which transport is
+// used.
+type transport interface {
+	// prepare is called before the process is started.
+	prepare(cmd *exec.Cmd) error
+
+	// connect is called after the process is started. It will be tried again
+	// until it succeeds, or the backend did not start in time.
+	connect() (io.ReadWriteCloser, error)
+
+	// cleanup is called once the process has exited.
+	cleanup()
+}
+
+func newTransport(name string) (transport, error) {
+	switch name {
+	case "", TransportTCP:
+		return &tcpTransport{}, nil
+
+	case TransportStdio:
+		return &stdioTransport{}, nil
+
+	case TransportUnix:
+		return &unixTransport{}, nil
+	}
+
+	return nil, fmt.Errorf("unknown transport %q", name)
+}
+
+// setDeadline is ignored by connections that do not support deadlines.
+func setDeadline(conn io.ReadWriteCloser, t time.Time) {
+	if c, ok := conn.(interface{ SetDeadline(time.Time) error }); ok {
+		_ = c.SetDeadline(t)
+	}
+}
+
+// setReadDeadline is ignored by connections that do not support deadlines.
+func setReadDeadline(conn io.ReadWriteCloser, t time.Time) {
+	if c, ok := conn.(interface{ SetReadDeadline(time.Time) error }); ok {
+		_ = c.SetReadDeadline(t)
+	}
+}
+
+// tcpTransport is the default. The backend listens on BENTO_PORT.
+type tcpTransport struct {
+	port int
+}
+
+func (transport *tcpTransport) prepare(cmd *exec.Cmd) (err error) {
+	transport.port, err = freePort()
+	cmd.Env = append(cmd.Env, fmt.Sprintf("BENTO_PORT=%d", transport.port))
+
+	return
+}
+
+func (transport *tcpTransport) connect() (io.ReadWriteCloser, error) {
+	return net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", transport.port))
+}
+
+func (transport *tcpTransport) cleanup() {}
+
+// freePort asks the operating system for a port that is not being used.
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	return port, listener.Close()
+}
+
+// unixTransport uses a unix domain socket at BENTO_SOCKET. The socket is
+// created in a directory that only the current user can access, so that other
+// users cannot connect to the backend.
+type unixTransport struct {
+	dir string
+}
+
+func (transport *unixTransport) prepare(cmd *exec.Cmd) (err error) {
+	transport.dir, err = ioutil.TempDir("", "bento")
+	if err != nil {
+		return
+	}
+
+	// TempDir already uses 0700, but that is too important to rely on.
+	err = os.Chmod(transport.dir, 0700)
+	if err != nil {
+		transport.cleanup()
+
+		return
+	}
+
+	cmd.Env = append(cmd.Env, "BENTO_SOCKET="+transport.socket())
+
+	return
+}
+
+func (transport *unixTransport) socket() string {
+	return filepath.Join(transport.dir, "backend.sock")
+}
+
+func (transport *unixTransport) connect() (io.ReadWriteCloser, error) {
+	return net.Dial("unix", transport.socket())
+}
+
+func (transport *unixTransport) cleanup() {
+	_ = os.RemoveAll(transport.dir)
+}
+
+// stdioTransport sends requests to the stdin of the backend and reads the
+// responses from its stdout.
+type stdioTransport struct {
+	conn *stdioConn
+
+	// stdin and stdout are the ends of the pipes that belong to the process.
+	stdin, stdout *os.File
+}
+
+type stdioConn struct {
+	stdin  *os.File // requests are written here
+	stdout *os.File // responses are read from here
+}
+
+func (transport *stdioTransport) prepare(cmd *exec.Cmd) (err error) {
+	transport.conn = &stdioConn{}
+
+	transport.stdin, transport.conn.stdin, err = os.Pipe()
+	if err != nil {
+		return
+	}
+
+	transport.conn.stdout, transport.stdout, err = os.Pipe()
+	if err != nil {
+		_ = transport.stdin.Close()
+		_ = transport.conn.stdin.Close()
+
+		return
+	}
+
+	cmd.Stdin = transport.stdin
+	cmd.Stdout = transport.stdout
+
+	return
+}
+
+func (transport *stdioTransport) connect() (io.ReadWriteCloser, error) {
+	// The process has its own copy of these now. They must be closed here so
+	// that the end of stdout is seen when the process exits.
+	if transport.stdin != nil {
+		_ = transport.stdin.Close()
+		_ = transport.stdout.Close()
+		transport.stdin, transport.stdout = nil, nil
+	}
+
+	return transport.conn, nil
+}
+
+// cleanup also closes the pipes in case connect was never called.
+func (transport *stdioTransport) cleanup() {
+	if transport.stdin != nil {
+		_ = transport.stdin.Close()
+		_ = transport.stdout.Close()
+	}
+
+	_ = transport.conn.Close()
+}
+
+func (conn *stdioConn) Read(p []byte) (int, error) {
+	return conn.stdout.Read(p)
+}
+
+func (conn *stdioConn) Write(p []byte) (int, error) {
+	return conn.stdin.Write(p)
+}
+
+// Close will also close the stdin of the process.
+func (conn *stdioConn) Close() error {
+	err := conn.stdin.Close()
+	_ = conn.stdout.Close()
+
+	return err
+}
+
+func (conn *stdioConn) SetDeadline(t time.Time) error {
+	err := conn.stdin.SetDeadline(t)
+	_ = conn.stdout.SetDeadline(t)
+
+	return err
+}
+
+func (conn *stdioConn) SetReadDeadline(t time.Time) error {
+	return conn.stdout.SetReadDeadline(t)
+}
@@ -4,8 +4,40 @@ const (
 	VariableTypeBlackhole = "blackhole"
 	VariableTypeText      = "text"
 	VariableTypeNumber    = "number"
+	VariableTypeCSV       = "csv"
+	VariableTypeCSVRow    = "csv-row"
+	VariableTypeJSON      = "json"
 )
 
+// These text variables are declared automatically when "try" is used. They
+// describe the most recent failure, or are empty if the sentence in the last
+// "try" did not fail. They belong to the virtual machine rather than the
+// program, so they cannot be declared or loaded from settings.
+const (
+	ErrorVariable         = "error"
+	ErrorSentenceVariable = "error-sentence"
+	ErrorBackendVariable  = "error-backend"
+	ErrorCodeVariable     = "error-code"
+)
+
+var errorVariables = []string{
+	ErrorVariable,
+	ErrorSentenceVariable,
+	ErrorBackendVariable,
+	ErrorCodeVariable,
+}
+
+// isBackendType is true for any type that is not built in.
+func isBackendType(variableType string) bool {
+	switch variableType {
+	case "", VariableTypeBlackhole, VariableTypeText, VariableTypeNumber,
+		VariableTypeCSV, VariableTypeCSVRow, VariableTypeJSON:
+		return false
+	}
+
+	return true
+}
+
 type VariableDefinition struct {
 	Name string
 	Type string
@@ -17,12 +49,50 @@ type VariableDefinition struct {
 	Precision int
 }
 
+// ConstantDefinition is a named value that is defined at the top of the file
+// with "define". It can be used anywhere a literal value can be used.
+type ConstantDefinition struct {
+	Name string
+
+	// Value is the literal text or number.
+	Value interface{}
+}
+
+// Type returns the type of the constant value.
+func (constant *ConstantDefinition) Type() string {
+	if _, ok := constant.Value.(*Number); ok {
+		return VariableTypeNumber
+	}
+
+	return VariableTypeText
+}
+
 type VariableReference string
 
 var BlackholeVariable = VariableReference("_")
 
 var blackholeVariableIndex = -1
 
+// fileVariableIndex encodes the position of a file-level variable as an
+// argument index. They are negative (below the blackhole) so they can never
+// overlap with the variables of a function.
+func fileVariableIndex(i int) int {
+	return blackholeVariableIndex - 1 - i
+}
+
 func NewText(s string) *string {
 	return &s
 }
+
+// copyValue returns a new text or number with the same value.
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *string:
+		return NewText(*v)
+
+	case *Number:
+		return NewNumber(v.Rat.RatString(), v.Precision)
+	}
+
+	return value
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 type Instruction interface{}
@@ -28,86 +34,192 @@ type JumpInstruction struct {
 type CallInstruction struct {
 	Call string
 	Args []int
+
+	// Literals are the positions of the arguments that are literals or
+	// constants. They are only needed for sentences sent to a backend, which
+	// must not be allowed to change them, and for functions, which receive a
+	// copy of them.
+	Literals []int
 }
 
 type QuestionAnswerInstruction struct {
 	Yes bool
 }
 
+// IterateInstruction starts a "for each" loop by creating the iterator
+// described by Call.
+type IterateInstruction struct {
+	Call string
+	Args []int
+}
+
+// NextInstruction sets Variable to the next value of the most recent iterator.
+// Once there are no more values the iterator is removed and it jumps to False.
+type NextInstruction struct {
+	Variable    int
+	True, False int
+}
+
+// TryInstruction runs Try. If it fails the details are put into the error
+// variables and OnFailure is run. Finally is always run. OnFailure and Finally
+// may be nil.
+type TryInstruction struct {
+	Try, OnFailure, Finally Instruction
+
+	Error, ErrorSentence, ErrorBackend, ErrorCode int
+}
+
+// AssertionFailedInstruction always fails. It is jumped over when the assertion
+// is true.
+type AssertionFailedInstruction struct {
+	// Assertion is how it was written, such as "total > 0".
+	Assertion string
+}
+
+// LoadSettingsInstruction reads a settings file into the variables with the
+// same name as each setting.
+type LoadSettingsInstruction struct {
+	Path int
+
+	// Variables are all of the file-level text and number variables that can
+	// be set, by name.
+	Variables map[string]int
+
+	// Required is true for "load required settings from ?". Every one of the
+	// Variables must be in the file.
+	Required bool
+}
+
+// Syntax is the sentence that the instruction was compiled from.
+func (instruction *LoadSettingsInstruction) Syntax() string {
+	if instruction.Required {
+		return "load required settings from ?"
+	}
+
+	return "load settings from ?"
+}
+
 type VirtualMachine struct {
 	program     *CompiledProgram
 	memory      []interface{}
+	variables   []interface{} // file-level variables
 	stackOffset []int
 	out         io.Writer
 	answer      bool
-	backends    []*Backend
+	iterators   []Iterator
+
+	// terminal is true when out is a terminal, so that the progress of a
+	// backend can be shown on a single line.
+	terminal bool
+
+	// backends are all of the backends that are running. They must all be
+	// shut down before bento exits.
+	backends      []*Backend
+	backendsMutex sync.Mutex
+
+	// backendErrors are the reasons that backends could not be started, by
+	// name. They are also guarded by backendsMutex.
+	backendErrors map[string]error
+
+	// in is where answers are read from when asking the person running the
+	// program. It will be nil when running non-interactively.
+	in io.Reader
+
+	// dir is the directory of the program being run. Relative file paths used
+	// in the program are relative to this directory.
+	dir string
+
+	// http is created when the first HTTP option or request is used.
+	http *httpOptions
+
+	// failure is the error from the sentence in the most recent "try". It is
+	// nil if that sentence did not fail.
+	failure error
 }
 
 func NewVirtualMachine(program *CompiledProgram) *VirtualMachine {
 	return &VirtualMachine{
 		program: program,
 		out:     os.Stdout,
+		in:      os.Stdin,
 	}
 }
 
-func (vm *VirtualMachine) Run() error {
-	vm.stackOffset = []int{0}
+// Run will call the start function. The args are the values for each of the
+// arguments of start, if any.
+func (vm *VirtualMachine) Run(args ...interface{}) error {
+	// The arguments are placed at the bottom of the memory as if they were the
+	// variables of a caller.
+	vm.memory = append(vm.memory[:0], args...)
+	vm.stackOffset = []int{0, len(args)}
+
+	var argIndexes []int
+	for i := range args {
+		argIndexes = append(argIndexes, i)
+	}
+
+	// File-level variables live for the whole run, so their instances are
+	// only created once.
+	vm.variables = append([]interface{}(nil), vm.program.Variables...)
+
+	// Backends are always shut down, even if there is an error.
+	defer vm.Close()
+
+	instances := newBackendInstances(vm.variables)
+	defer vm.destroyInstances(instances)
 
 	// TODO: Check start exists.
-	return vm.call("start", nil)
+	return vm.call(&CallInstruction{Call: "start", Args: argIndexes})
 }
 
-func (vm *VirtualMachine) call(syntax string, args []int) error {
+func (vm *VirtualMachine) call(instruction *CallInstruction) error {
+	syntax, args := instruction.Call, instruction.Args
 	fn := vm.program.Functions[syntax]
 
 	if fn == nil {
 		// Maybe it belongs to a backend?
-		for _, arg := range args {
-			// TODO: It is ambiguous if a sentence contains more than one
-			//  backend.
-			if backend, ok := vm.GetArg(arg).(*Backend); ok {
-				// TODO: Make sure syntax exists
-				var realArgs []string
-				for _, realArg := range args {
-					realArgs = append(realArgs, fmt.Sprintf("%v", vm.GetArg(realArg)))
-				}
-				result, err := backend.send(&BackendRequest{
-					Sentence: syntax,
-					Args:     realArgs,
-				})
-				if err != nil {
-					panic(err)
-				}
+		instance, err := vm.findBackendForSentence(syntax, args)
+		if runtimeErr, ok := err.(*RuntimeError); ok {
+			runtimeErr.Sentence = syntax
 
-				for key, value := range result.Set {
-					index, err := strconv.Atoi(key[1:])
-					if err != nil {
-						panic(err)
-					}
-
-					vm.SetArg(index, NewText(value))
-				}
+			return runtimeErr
+		}
 
-				return nil
-			}
+		if err != nil {
+			return &RuntimeError{Sentence: syntax, Err: err}
 		}
 
-		return fmt.Errorf("no such function: %s", syntax)
-	}
+		if instance != nil {
+			err := vm.callBackend(instance, instruction)
 
-	// Start backends.
-	// TODO: Backends are not closed.
-	for _, variable := range fn.Variables {
-		if backend, ok := variable.(*Backend); ok {
-			err := backend.Start()
-			if err != nil {
+			// A callback may have stopped the program.
+			if _, ok := err.(*StopError); ok {
 				return err
 			}
+
+			if err != nil {
+				return &RuntimeError{
+					Sentence: syntax,
+					Backend:  instance.Name,
+					Err:      err,
+				}
+			}
+
+			return nil
+		}
+
+		return &RuntimeError{
+			Sentence: syntax,
+			Err:      fmt.Errorf("no such function: %s", syntax),
 		}
 	}
 
 	fn.InstructionOffset = 0
 
+	// A loop that is left because of an error will never finish, so its
+	// iterator must not outlive the function.
+	defer vm.discardIterators(len(vm.iterators))
+
 	// Expand the memory to accommodate the variables (arguments and constants
 	// used in the function).
 	// TODO: Refactor this in a much more efficient way.
@@ -119,61 +231,715 @@ func (vm *VirtualMachine) call(syntax string, args []int) error {
 		vm.memory[offset+i] = v
 	}
 
-	// Load in the arguments.
+	// Load in the arguments. The stack has not been increased yet so the
+	// arguments are still relative to the caller.
 	for i, arg := range args {
 		to := vm.stackOffset[len(vm.stackOffset)-1] + i
-		from := vm.stackOffset[len(vm.stackOffset)-2] + arg
-		vm.memory[to] = vm.memory[from]
+		vm.memory[to] = vm.GetArg(arg)
+	}
+
+	// A function can change a number argument, which must not change the
+	// value of a literal or constant the next time it is used.
+	for _, literal := range instruction.Literals {
+		vm.memory[offset+literal] = copyValue(vm.memory[offset+literal])
 	}
 
+	// Each call has its own instances for the backend variables declared in
+	// the function. They only exist until it returns, and are not created
+	// until they are used.
+	locals := vm.memory[offset+len(args) : offset+len(fn.Variables)]
+	instances := newBackendInstances(locals)
+	defer vm.destroyInstances(instances)
+
 	vm.stackOffset = append(vm.stackOffset,
 		vm.stackOffset[len(vm.stackOffset)-1]+len(fn.Variables))
 
 	for fn.InstructionOffset < len(fn.Instructions) {
-		instruction := fn.Instructions[fn.InstructionOffset]
+		move, err := vm.executeInstruction(fn.Instructions[fn.InstructionOffset])
+		if err != nil {
+			vm.stackOffset = vm.stackOffset[:len(vm.stackOffset)-1]
 
-		var move int
-		var err error
+			return err
+		}
 
-		// TODO: This switch needs to be refactored into an interface.
-		switch ins := instruction.(type) {
-		case *CallInstruction:
-			move, err = vm.callInstruction(ins)
+		fn.InstructionOffset += move
+	}
 
-		case *ConditionJumpInstruction:
-			move, err = vm.conditionJumpInstruction(ins)
+	vm.stackOffset = vm.stackOffset[:len(vm.stackOffset)-1]
 
-		case *JumpInstruction:
-			move, err = vm.jumpInstruction(ins)
+	return nil
+}
 
-		case *QuestionJumpInstruction:
-			move, err = vm.questionJumpInstruction(ins)
+// findBackendForSentence returns the backend instance that the sentence is
+// sent to. Only one of the backends in the sentence can have the sentence. If there
+// are several variables for that backend, it is sent to the first one and the
+// others are only passed as arguments. It returns nil if there are no backends
+// in the sentence.
+//
+// Any of the instances that have not been used before are created first, which
+// also starts their backends.
+func (vm *VirtualMachine) findBackendForSentence(syntax string, args []int) (*BackendInstance, error) {
+	var all []*BackendInstance
+	for _, arg := range args {
+		if instance, ok := vm.GetArg(arg).(*BackendInstance); ok {
+			all = append(all, instance)
+		}
+	}
 
-		case *QuestionAnswerInstruction:
-			move, err = vm.questionAnswerInstruction(ins)
+	if err := vm.createInstances(all); err != nil {
+		return nil, err
+	}
 
-		default:
-			panic(ins)
+	var names []string
+	instances := map[string]*BackendInstance{}
+	sentences := map[string][]*BackendSentence{}
+
+	for _, instance := range all {
+		if instances[instance.Name] != nil {
+			continue
 		}
 
+		names = append(names, instance.Name)
+		instances[instance.Name] = instance
+
+		// The sentences of a running backend are always known.
+		sentences[instance.Name] = append([]*BackendSentence{},
+			instance.backend.Sentences...)
+	}
+
+	name, err := findSentenceProvider(syntax, names, sentences)
+
+	return instances[name], err
+}
+
+// callBackend sends the sentence to the backend. If the backend provided the
+// types of the arguments they are checked before it is sent.
+func (vm *VirtualMachine) callBackend(instance *BackendInstance, instruction *CallInstruction) error {
+	syntax, args := instruction.Call, instruction.Args
+	backend := instance.backend
+
+	signature := backend.sentence(syntax)
+	if signature == nil {
+		signature = &BackendSentence{Sentence: syntax}
+	}
+
+	var requestArgs []interface{}
+	for i, arg := range args {
+		value, err := vm.backendArg(instance, signature, i, arg)
 		if err != nil {
 			return err
 		}
 
-		fn.InstructionOffset += move
+		requestArgs = append(requestArgs, value)
 	}
 
-	vm.stackOffset = vm.stackOffset[:len(vm.stackOffset)-1]
+	result, err := vm.sendToBackend(backend, &BackendRequest{
+		Sentence: syntax,
+		Args:     requestArgs,
+	}, vm.runCallback)
+	if err != nil {
+		return err
+	}
+
+	if result.failed() {
+		return result.Error
+	}
+
+	// The keys are sorted so that the same error is always reported first.
+	var keys []string
+	for key := range result.Set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if err := vm.setBackendValue(instruction, signature, key,
+			string(result.Set[key])); err != nil {
+			return fmt.Errorf("cannot set %q: %v", key, err)
+		}
+	}
 
 	return nil
 }
 
+// sendToBackend sends the request and handles the interim messages from the
+// backend before the final response. Callbacks are run with callback, or
+// refused if it is nil. If a callback stops the program the backend is told, and
+// the StopError is returned once the request has finished.
+func (vm *VirtualMachine) sendToBackend(backend *Backend, request *BackendRequest, callback func(string, []BackendValue) (*BackendCallbackResult, error)) (*BackendResponse, error) {
+	display := &progressDisplay{out: vm.out, terminal: vm.terminal}
+	defer display.finish()
+
+	var stopErr error
+	response, err := backend.send(request,
+		func(message *BackendResponse) *BackendCallbackResult {
+			switch {
+			case message.Output != nil:
+				display.output(*message.Output)
+
+				return nil
+
+			case message.Progress != nil:
+				display.progress(*message.Progress, message.Message)
+
+				return nil
+
+			case callback == nil:
+				return &BackendCallbackResult{
+					Error: "callbacks are not supported for this request",
+				}
+			}
+
+			// Anything the callback displays must not be written on the
+			// progress line.
+			display.finish()
+
+			result, err := callback(message.Callback, message.Args)
+			if _, ok := err.(*StopError); ok {
+				stopErr = err
+
+				return &BackendCallbackResult{Error: "the program is stopping"}
+			}
+
+			if err != nil {
+				return &BackendCallbackResult{Error: err.Error()}
+			}
+
+			return result
+		})
+
+	if stopErr != nil {
+		return nil, stopErr
+	}
+
+	return response, err
+}
+
+// isCallbackSentence returns true for the inbuilt sentences that a backend can
+// use as a callback. They only have text arguments, so that any value sent by
+// the backend can be used.
+func isCallbackSentence(syntax string) bool {
+	switch {
+	case syntax == "display",
+		strings.HasPrefix(syntax, "display ?"),
+		strings.HasPrefix(syntax, "choose one of ?"),
+		syntax == "ask ? into ?",
+		syntax == "confirm ?",
+		syntax == "file ? exists":
+		return System[syntax] != nil
+	}
+
+	return false
+}
+
+// runCallback runs a sentence that a backend has asked for. It can be any
+// sentence in the program, or one of the inbuilt sentences allowed by
+// isCallbackSentence. The values are placed above the current function, as if
+// they were the variables of a caller, and converted to the types of the
+// arguments of the sentence. Their values after the sentence has run are sent
+// back to the backend.
+func (vm *VirtualMachine) runCallback(syntax string, args []BackendValue) (*BackendCallbackResult, error) {
+	fn := vm.program.Functions[syntax]
+
+	if fn == nil && !isCallbackSentence(syntax) {
+		return nil, fmt.Errorf("no such sentence: %s", syntax)
+	}
+
+	if placeholders := strings.Count(syntax, "?"); placeholders != len(args) {
+		return nil, fmt.Errorf(`"%s" needs %d arguments, but got %d`,
+			syntax, placeholders, len(args))
+	}
+
+	offset := vm.stackOffset[len(vm.stackOffset)-1]
+	var argIndexes []int
+	for i, arg := range args {
+		var value interface{} = NewText(string(arg))
+
+		if fn != nil {
+			switch expected := fn.Variables[i].(type) {
+			case *string:
+
+			case *Number:
+				number, err := ParseNumber(string(arg), expected.Precision)
+				if err != nil {
+					return nil, argTypeError(syntax, i, VariableTypeNumber,
+						fmt.Sprintf("%q", arg))
+				}
+
+				value = number
+
+			default:
+				return nil, fmt.Errorf(
+					`argument %d of "%s" cannot be set by a backend`, i+1,
+					syntax)
+			}
+		}
+
+		for offset+i >= len(vm.memory) {
+			vm.memory = append(vm.memory, nil)
+		}
+		vm.memory[offset+i] = value
+		argIndexes = append(argIndexes, i)
+	}
+
+	// The answer of the sentence that is waiting for the backend must not be
+	// changed by the callback.
+	answer := vm.answer
+	vm.stackOffset = append(vm.stackOffset, offset+len(args))
+	defer func() {
+		vm.stackOffset = vm.stackOffset[:len(vm.stackOffset)-1]
+		vm.answer = answer
+	}()
+
+	_, err := vm.callInstruction(&CallInstruction{
+		Call: syntax,
+		Args: argIndexes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &BackendCallbackResult{Answer: vm.answer}
+	if len(args) > 0 {
+		result.Set = map[string]interface{}{}
+	}
+
+	for i := range args {
+		key := fmt.Sprintf("$%d", i)
+		switch value := vm.memory[offset+i].(type) {
+		case *Number:
+			result.Set[key] = json.Number(value.String())
+
+		default:
+			result.Set[key] = valueString(value)
+		}
+	}
+
+	return result, nil
+}
+
+// setBackendValue sets the variable for a "set" key such as "$1" (the second
+// placeholder). The value is converted to the type of the variable.
+func (vm *VirtualMachine) setBackendValue(instruction *CallInstruction, signature *BackendSentence, key, value string) error {
+	i, err := strconv.Atoi(strings.TrimPrefix(key, "$"))
+	if err != nil || !strings.HasPrefix(key, "$") {
+		return errors.New(`must be "$" followed by the position of the ` +
+			`argument, such as "$0"`)
+	}
+
+	if i < 0 || i >= len(instruction.Args) {
+		return fmt.Errorf("there are only %d arguments",
+			len(instruction.Args))
+	}
+
+	for _, literal := range instruction.Literals {
+		if literal == i {
+			return errors.New("it is not a variable")
+		}
+	}
+
+	if signature.returnType(i) == SentenceArgNumber {
+		if _, err := ParseNumber(value, UnlimitedPrecision); err != nil {
+			return err
+		}
+	}
+
+	return vm.SetArgText(instruction.Args[i], value)
+}
+
+// backendArg is the value that is sent to the backend for the argument at
+// position i.
+func (vm *VirtualMachine) backendArg(instance *BackendInstance, signature *BackendSentence, i, arg int) (interface{}, error) {
+	value := vm.GetArg(arg)
+	expected := signature.argType(i)
+
+	switch expected {
+	case SentenceArgNumber:
+		if number, ok := value.(*Number); ok {
+			// A JSON number can have any number of digits, so it is always
+			// exactly the same value.
+			return json.Number(number.String()), nil
+		}
+
+	case SentenceArgText:
+		if text, ok := value.(*string); ok {
+			return *text, nil
+		}
+
+	case SentenceArgSelf:
+		if value == instance {
+			return instance.String(), nil
+		}
+
+		expected = "the " + instance.Name + " variable"
+
+	case SentenceArgAny:
+		if text, ok := value.(*string); ok {
+			return *text, nil
+		}
+
+		return fmt.Sprintf("%v", value), nil
+
+	default:
+		// Another backend is sent as a handle.
+		if other, ok := value.(*BackendInstance); ok && other.Name == expected {
+			return other.String(), nil
+		}
+
+		expected = "a " + expected + " variable"
+	}
+
+	return nil, argTypeError(signature.Sentence, i, expected,
+		vm.GetArgType(arg))
+}
+
+// newBackendInstances replaces each backend variable with a new instance, and
+// returns them.
+func newBackendInstances(variables []interface{}) (instances []*BackendInstance) {
+	var names []string
+	for i, variable := range variables {
+		if instance, ok := variable.(*BackendInstance); ok {
+			variables[i] = NewBackendInstance(instance.Name)
+			instances = append(instances, variables[i].(*BackendInstance))
+			names = appendUnique(names, instance.Name)
+		}
+	}
+
+	for _, instance := range instances {
+		instance.declaredWith = names
+	}
+
+	return
+}
+
+// createInstances creates each of the instances that have not been created
+// yet. Any backends that are not already running are started first, along
+// with the other backends that were declared with them, because they are
+// likely to be needed soon. Backends are started at the same time because some
+// can take a while to start.
+func (vm *VirtualMachine) createInstances(instances []*BackendInstance) error {
+	var names []string
+	var created []*BackendInstance
+	for _, instance := range instances {
+		if instance.backend != nil {
+			continue
+		}
+
+		created = append(created, instance)
+		for _, name := range append([]string{instance.Name},
+			instance.declaredWith...) {
+			if backend, err := vm.runningBackend(name); backend == nil &&
+				err == nil {
+				names = appendUnique(names, name)
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			vm.startBackend(NewBackend(name))
+		}(name)
+	}
+	wg.Wait()
+
+	for _, instance := range created {
+		backend, err := vm.runningBackend(instance.Name)
+		if err != nil {
+			return &RuntimeError{Backend: instance.Name, Err: err}
+		}
+
+		id, err := backend.newInstance()
+		if err != nil {
+			return &RuntimeError{Backend: instance.Name, Err: err}
+		}
+
+		instance.ID = id
+		instance.backend = backend
+	}
+
+	return nil
+}
+
+// destroyInstances is only needed for backends that support instances.
+func (vm *VirtualMachine) destroyInstances(instances []*BackendInstance) {
+	for _, instance := range instances {
+		if instance.ID != "" && instance.backend != nil &&
+			instance.backend.isRunning() {
+			vm.logError(instance.backend.destroyInstance(instance.ID))
+		}
+	}
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+
+	return append(values, value)
+}
+
+// startBackend keeps track of every backend that is started so that they can
+// all be shut down. A backend that cannot be started is not tried again.
+func (vm *VirtualMachine) startBackend(backend *Backend) {
+	err := backend.Start()
+
+	vm.backendsMutex.Lock()
+	defer vm.backendsMutex.Unlock()
+
+	if err != nil {
+		if vm.backendErrors == nil {
+			vm.backendErrors = map[string]error{}
+		}
+
+		vm.backendErrors[backend.Name] = err
+
+		return
+	}
+
+	vm.backends = append(vm.backends, backend)
+}
+
+// runningBackend returns nil if the backend has not been started. The error is
+// why it could not be started, if it has been tried.
+func (vm *VirtualMachine) runningBackend(name string) (*Backend, error) {
+	vm.backendsMutex.Lock()
+	defer vm.backendsMutex.Unlock()
+
+	for _, backend := range vm.backends {
+		if backend.Name == name {
+			return backend, nil
+		}
+	}
+
+	return nil, vm.backendErrors[name]
+}
+
+// Close shuts down all of the backends that are still running. It is safe to
+// call from another goroutine, such as when the program is interrupted.
+func (vm *VirtualMachine) Close() {
+	vm.backendsMutex.Lock()
+	backends := vm.backends
+	vm.backends = nil
+	vm.backendsMutex.Unlock()
+
+	// They are shut down in the reverse order that they were started.
+	for i := len(backends) - 1; i >= 0; i-- {
+		vm.logError(backends[i].Close())
+	}
+}
+
+// logError is for errors that cannot be returned, like those that happen
+// while shutting down.
+func (vm *VirtualMachine) logError(err error) {
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// executeInstruction returns how many instructions to move forward.
+func (vm *VirtualMachine) executeInstruction(instruction Instruction) (move int, err error) {
+	// TODO: This switch needs to be refactored into an interface.
+	switch ins := instruction.(type) {
+	case *CallInstruction:
+		move, err = vm.callInstruction(ins)
+
+	case *ConditionJumpInstruction:
+		move, err = vm.conditionJumpInstruction(ins)
+
+	case *JumpInstruction:
+		move, err = vm.jumpInstruction(ins)
+
+	case *QuestionJumpInstruction:
+		move, err = vm.questionJumpInstruction(ins)
+
+	case *QuestionAnswerInstruction:
+		move, err = vm.questionAnswerInstruction(ins)
+
+	case *LoadSettingsInstruction:
+		move, err = vm.loadSettingsInstruction(ins)
+		if err != nil {
+			err = &RuntimeError{Sentence: ins.Syntax(), Err: err}
+		}
+
+	case *IterateInstruction:
+		move, err = vm.iterateInstruction(ins)
+
+	case *NextInstruction:
+		move, err = vm.nextInstruction(ins)
+
+	case *TryInstruction:
+		move, err = vm.tryInstruction(ins)
+
+	case *AssertionFailedInstruction:
+		err = &RuntimeError{
+			Sentence: WordAssert + " " + ins.Assertion,
+			Err:      &AssertionError{Assertion: ins.Assertion},
+		}
+
+	default:
+		panic(ins)
+	}
+
+	return
+}
+
+func (vm *VirtualMachine) tryInstruction(instruction *TryInstruction) (int, error) {
+	vm.setFailure(instruction, nil)
+	iterators := len(vm.iterators)
+
+	_, err := vm.executeInstruction(instruction.Try)
+
+	// Stopping the program is not a failure, so it cannot be handled. However,
+	// the finally is still run.
+	_, isStop := err.(*StopError)
+
+	if err != nil && !isStop {
+		// Any loops inside of the sentence that failed will never finish.
+		vm.discardIterators(iterators)
+		vm.setFailure(instruction, err)
+
+		if instruction.OnFailure != nil {
+			_, err = vm.executeInstruction(instruction.OnFailure)
+		}
+	}
+
+	// A failure in finally takes the place of any previous failure.
+	if instruction.Finally != nil {
+		if _, finallyErr := vm.executeInstruction(instruction.Finally); finallyErr != nil {
+			err = finallyErr
+		}
+	}
+
+	return 1, err
+}
+
+// setFailure puts the details of err into the error variables. They are all
+// empty when err is nil.
+func (vm *VirtualMachine) setFailure(instruction *TryInstruction, err error) {
+	var message, sentence, backend, code string
+	if err != nil {
+		message = err.Error()
+	}
+
+	if runtimeErr, ok := err.(*RuntimeError); ok {
+		sentence = runtimeErr.Sentence
+		backend = runtimeErr.Backend
+	}
+
+	if backendErr := backendError(err); backendErr != nil {
+		code = backendErr.Code
+	}
+
+	vm.failure = err
+	vm.SetArg(instruction.Error, NewText(message))
+	vm.SetArg(instruction.ErrorSentence, NewText(sentence))
+	vm.SetArg(instruction.ErrorBackend, NewText(backend))
+	vm.SetArg(instruction.ErrorCode, NewText(code))
+}
+
 func (vm *VirtualMachine) questionAnswerInstruction(instruction *QuestionAnswerInstruction) (int, error) {
 	vm.answer = instruction.Yes
 
 	return 1, nil
 }
 
+func (vm *VirtualMachine) iterateInstruction(instruction *IterateInstruction) (int, error) {
+	iterator, err := Iterators[instruction.Call](vm, instruction.Args)
+	if err != nil {
+		return 0, err
+	}
+
+	vm.iterators = append(vm.iterators, iterator)
+
+	return 1, nil
+}
+
+func (vm *VirtualMachine) nextInstruction(instruction *NextInstruction) (int, error) {
+	iterator := vm.iterators[len(vm.iterators)-1]
+
+	value, ok, err := iterator.Next()
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok {
+		vm.discardIterators(len(vm.iterators) - 1)
+
+		return instruction.False, nil
+	}
+
+	// Values read from outside of the program are provided as text or json so
+	// they can be converted to the type of the variable.
+	switch v := value.(type) {
+	case string:
+		err = vm.SetArgText(instruction.Variable, v)
+
+	case *JSONValue:
+		err = vm.SetArgJSON(instruction.Variable, v.Value)
+
+	default:
+		vm.SetArg(instruction.Variable, value)
+	}
+
+	return instruction.True, err
+}
+
+// discardIterators removes the iterators above n, such as when a loop is left
+// because of an error. Any resources they hold (like open files) are released.
+func (vm *VirtualMachine) discardIterators(n int) {
+	for _, iterator := range vm.iterators[n:] {
+		if closer, ok := iterator.(io.Closer); ok {
+			vm.logError(closer.Close())
+		}
+	}
+
+	vm.iterators = vm.iterators[:n]
+}
+
+func (vm *VirtualMachine) loadSettingsInstruction(instruction *LoadSettingsInstruction) (int, error) {
+	path := vm.path(valueString(vm.GetArg(instruction.Path)))
+
+	settings, err := ReadSettings(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var names []string
+	for name := range instruction.Variables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if instruction.Required {
+		for _, name := range names {
+			if _, ok := settings[name]; !ok {
+				return 0, fmt.Errorf(`%s: missing required setting "%s"`,
+					path, name)
+			}
+		}
+	}
+
+	// A variable that is not in the file keeps its value.
+	for _, name := range names {
+		value, ok := settings[name]
+		if !ok {
+			continue
+		}
+
+		err := vm.SetArgText(instruction.Variables[name], value)
+		if err != nil {
+			return 0, fmt.Errorf(`%s: setting "%s": %v`, path, name, err)
+		}
+	}
+
+	return 1, nil
+}
+
 func (vm *VirtualMachine) conditionJumpInstruction(instruction *ConditionJumpInstruction) (int, error) {
 	cmp := 0
 	left := vm.GetArg(instruction.Left)
@@ -247,13 +1013,27 @@ func (vm *VirtualMachine) callInstruction(instruction *CallInstruction) (int, er
 
 	// Check if it is a system call?
 	if handler, ok := System[instruction.Call]; ok {
-		handler(vm, instruction.Args)
+		err := handler(vm, instruction.Args)
+		if _, ok := err.(*StopError); ok {
+			return 0, err
+		}
+
+		// Such as a backend that could not be started.
+		if runtimeErr, ok := err.(*RuntimeError); ok {
+			runtimeErr.Sentence = instruction.Call
+
+			return 0, runtimeErr
+		}
+
+		if err != nil {
+			return 0, &RuntimeError{Sentence: instruction.Call, Err: err}
+		}
 
 		return 1, nil
 	}
 
 	// Otherwise we have to increase the stack.
-	return 1, vm.call(instruction.Call, instruction.Args)
+	return 1, vm.call(instruction)
 }
 
 func (vm *VirtualMachine) GetArg(index int) interface{} {
@@ -261,7 +1041,17 @@ func (vm *VirtualMachine) GetArg(index int) interface{} {
 		return nil
 	}
 
-	return vm.memory[vm.previousOffset()+index]
+	return *vm.ref(index)
+}
+
+// ref returns the location in memory of an argument. Indexes below the
+// blackhole refer to file-level variables.
+func (vm *VirtualMachine) ref(index int) *interface{} {
+	if index < blackholeVariableIndex {
+		return &vm.variables[blackholeVariableIndex-1-index]
+	}
+
+	return &vm.memory[vm.previousOffset()+index]
 }
 
 func (vm *VirtualMachine) previousOffset() int {
@@ -273,7 +1063,7 @@ func (vm *VirtualMachine) SetArg(index int, value interface{}) {
 		return
 	}
 
-	vm.memory[vm.previousOffset()+index] = value
+	*vm.ref(index) = value
 }
 
 func (vm *VirtualMachine) GetNumber(index int) *Number {
@@ -281,7 +1071,7 @@ func (vm *VirtualMachine) GetNumber(index int) *Number {
 		return NewNumber("0", DefaultNumericPrecision)
 	}
 
-	return vm.memory[vm.previousOffset()+index].(*Number)
+	return (*vm.ref(index)).(*Number)
 }
 
 func (vm *VirtualMachine) GetText(index int) *string {
@@ -289,7 +1079,43 @@ func (vm *VirtualMachine) GetText(index int) *string {
 		return NewText("")
 	}
 
-	return vm.memory[vm.previousOffset()+index].(*string)
+	return (*vm.ref(index)).(*string)
+}
+
+// SetArgText converts text from outside of the program (such as user input) to
+// the type of the destination variable.
+func (vm *VirtualMachine) SetArgText(index int, s string) error {
+	switch value := vm.GetArg(index).(type) {
+	case *string:
+		vm.SetArg(index, NewText(s))
+
+	case *Number:
+		number, err := ParseNumber(s, value.Precision)
+		if err != nil {
+			return err
+		}
+
+		value.Set(number)
+
+	case *JSONValue:
+		vm.SetArg(index, &JSONValue{Value: s})
+
+	case nil: // blackhole
+
+	default:
+		return fmt.Errorf("cannot set %s from text", vm.GetArgType(index))
+	}
+
+	return nil
+}
+
+// path resolves a file path used by the program.
+func (vm *VirtualMachine) path(path string) string {
+	if filepath.IsAbs(path) || vm.dir == "" {
+		return path
+	}
+
+	return filepath.Join(vm.dir, path)
 }
 
 func (vm *VirtualMachine) GetArgType(index int) string {
@@ -302,6 +1128,18 @@ func (vm *VirtualMachine) GetArgType(index int) string {
 
 	case *Number:
 		return VariableTypeNumber
+
+	case *CSVFile:
+		return VariableTypeCSV
+
+	case *CSVRow:
+		return VariableTypeCSVRow
+
+	case *JSONValue:
+		return VariableTypeJSON
+
+	case *BackendInstance:
+		return vm.GetArg(index).(*BackendInstance).Name
 	}
 
 	return reflect.TypeOf(vm.GetArg(index)).String()
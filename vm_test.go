@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 )
@@ -616,7 +618,8 @@ func TestVirtualMachine_ConditionTests(t *testing.T) {
 			require.NoError(t, err)
 
 			compiler := NewCompiler(program)
-			compiledProgram := compiler.Compile()
+			compiledProgram, err := compiler.Compile()
+			require.NoError(t, err)
 
 			vm := NewVirtualMachine(compiledProgram)
 			vm.out = bytes.NewBuffer(nil)
@@ -637,3 +640,261 @@ func TestVirtualMachine_ConditionTests(t *testing.T) {
 		})
 	}
 }
+
+func TestVirtualMachine_NonInteractive(t *testing.T) {
+	parser := NewParser(strings.NewReader(
+		"start: declare name is text\nask \"Name?\" into name",
+	))
+	program, err := parser.Parse()
+	require.NoError(t, err)
+
+	compiledProgram, err := NewCompiler(program).Compile()
+	require.NoError(t, err)
+
+	vm := NewVirtualMachine(compiledProgram)
+	vm.out = bytes.NewBuffer(nil)
+	vm.in = nil
+	err = vm.Run()
+
+	assert.EqualError(t, err, `cannot ask "Name?" because input is not `+
+		`available when running non-interactively`)
+}
+
+func TestVirtualMachine_LoadSettingsIgnoresLocals(t *testing.T) {
+	parser := NewParser(strings.NewReader(
+		"start: declare greeting is text\n" +
+			"load settings from \"tests/settings.env\"\n" +
+			"display \"[\" greeting \"]\"",
+	))
+	program, err := parser.Parse()
+	require.NoError(t, err)
+
+	compiledProgram, err := NewCompiler(program).Compile()
+	require.NoError(t, err)
+
+	vm := NewVirtualMachine(compiledProgram)
+	vm.out = bytes.NewBuffer(nil)
+	require.NoError(t, vm.Run())
+
+	assert.Equal(t, "[]\n", vm.out.(*bytes.Buffer).String())
+}
+
+func TestVirtualMachine_StopRunsFinally(t *testing.T) {
+	parser := NewParser(strings.NewReader(
+		"start:\n" +
+			"\ttry stop with status 3, on failure display \"failed\", " +
+			"finally display \"cleaning up\"\n" +
+			"\tdisplay \"not reached\"",
+	))
+	program, err := parser.Parse()
+	require.NoError(t, err)
+
+	compiledProgram, err := NewCompiler(program).Compile()
+	require.NoError(t, err)
+
+	vm := NewVirtualMachine(compiledProgram)
+	vm.out = bytes.NewBuffer(nil)
+	err = vm.Run()
+
+	assert.Equal(t, &StopError{Status: 3}, err)
+	assert.Equal(t, "cleaning up\n", vm.out.(*bytes.Buffer).String())
+}
+
+func TestVirtualMachine_ErrorVariablesAboveTry(t *testing.T) {
+	parser := NewParser(strings.NewReader(
+		"report failure:\n" +
+			"\tdisplay \"Failed: \" error\n" +
+			"start:\n" +
+			"\ttry read file \"tests/no-such-file\" into _, on failure report failure",
+	))
+	program, err := parser.Parse()
+	require.NoError(t, err)
+
+	compiledProgram, err := NewCompiler(program).Compile()
+	require.NoError(t, err)
+
+	vm := NewVirtualMachine(compiledProgram)
+	vm.out = bytes.NewBuffer(nil)
+	require.NoError(t, vm.Run())
+
+	assert.Equal(t, "Failed: open tests/no-such-file: no such file or "+
+		"directory\n", vm.out.(*bytes.Buffer).String())
+}
+
+func TestVirtualMachine_LoadRequiredSettings(t *testing.T) {
+	parser := NewParser(strings.NewReader(
+		"declare report-db is text\n" +
+			"declare greeting is text\n" +
+			"start: load required settings from \"tests/settings.env\"\n" +
+			"display greeting \", \" report-db\n" +
+			"try load required settings from \"tests/no-such-file.env\", " +
+			"on failure display error-sentence",
+	))
+	program, err := parser.Parse()
+	require.NoError(t, err)
+
+	compiledProgram, err := NewCompiler(program).Compile()
+	require.NoError(t, err)
+
+	vm := NewVirtualMachine(compiledProgram)
+	vm.out = bytes.NewBuffer(nil)
+	require.NoError(t, vm.Run())
+
+	assert.Equal(t, "Hello there, sales\nload required settings from ?\n",
+		vm.out.(*bytes.Buffer).String())
+}
+
+func TestVirtualMachine_LoadSettingsIgnoresErrorVariables(t *testing.T) {
+	file, err := ioutil.TempFile("", "bento-settings-*.env")
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+
+	_, err = file.WriteString("ERROR=oops\nGREETING=hi\n")
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	parser := NewParser(strings.NewReader(
+		"declare greeting is text\n" +
+			"start: try display \"ok\", on failure display error\n" +
+			"load settings from \"" + file.Name() + "\"\n" +
+			"display \"[\" greeting \"] [\" error \"]\"",
+	))
+	program, err := parser.Parse()
+	require.NoError(t, err)
+
+	compiledProgram, err := NewCompiler(program).Compile()
+	require.NoError(t, err)
+
+	vm := NewVirtualMachine(compiledProgram)
+	vm.out = bytes.NewBuffer(nil)
+	require.NoError(t, vm.Run())
+
+	assert.Equal(t, "ok\n[hi] []\n", vm.out.(*bytes.Buffer).String())
+}
+
+// closingIterator never runs out of values, and records when it is closed.
+type closingIterator struct {
+	closed *int
+}
+
+func (iterator *closingIterator) Next() (interface{}, bool, error) {
+	return "a", true, nil
+}
+
+func (iterator *closingIterator) Close() error {
+	*iterator.closed++
+
+	return nil
+}
+
+func TestVirtualMachine_ClosesIterators(t *testing.T) {
+	closed := 0
+	Iterators["in test ?"] = func(*VirtualMachine, []int) (Iterator, error) {
+		return &closingIterator{closed: &closed}, nil
+	}
+	defer delete(Iterators, "in test ?")
+
+	parser := NewParser(strings.NewReader(
+		"start:\n" +
+			"\ttry check lines, on failure display \"failed\"\n" +
+			"\tcheck lines\n" +
+			"check lines:\n" +
+			"\tdeclare line is text\n" +
+			"\tfor each line in test \"x\", " +
+			"read file \"tests/no-such-file\" into line",
+	))
+	program, err := parser.Parse()
+	require.NoError(t, err)
+
+	compiledProgram, err := NewCompiler(program).Compile()
+	require.NoError(t, err)
+
+	vm := NewVirtualMachine(compiledProgram)
+	vm.out = bytes.NewBuffer(nil)
+	err = vm.Run()
+
+	assert.EqualError(t, err,
+		"open tests/no-such-file: no such file or directory")
+	assert.Equal(t, "failed\n", vm.out.(*bytes.Buffer).String())
+	assert.Equal(t, 2, closed)
+	assert.Empty(t, vm.iterators)
+}
+
+var vmErrorTests = map[string]struct {
+	bento    string
+	expected string
+}{
+	"MissingEnvironmentVariable": {
+		bento: "start: declare db is text\n" +
+			"read environment variable \"BENTO_TEST_NOT_SET\" into db",
+		expected: "environment variable BENTO_TEST_NOT_SET is not set",
+	},
+	"ReadMissingFile": {
+		bento: "start: declare x is text\n" +
+			"read file \"tests/no-such-file\" into x",
+		expected: "open tests/no-such-file: no such file or directory",
+	},
+	"MissingRequiredSetting": {
+		bento: "declare report-db is text\n" +
+			"declare not-a-setting is text\n" +
+			"start: load required settings from \"tests/settings.env\"",
+		expected: `tests/settings.env: missing required setting "not-a-setting"`,
+	},
+	"InvalidSetting": {
+		bento: "declare greeting is number\n" +
+			"start: load settings from \"tests/settings.env\"",
+		expected: `tests/settings.env: setting "greeting": "Hello there" ` +
+			`is not a number`,
+	},
+	"MissingJSONField": {
+		bento: "start: declare doc is json\n" +
+			"declare email is text\n" +
+			"read field \"customer.email\" of doc into email",
+		expected: `no such field "customer.email"`,
+	},
+	"JSONFieldIsNotANumber": {
+		bento: "start: declare doc is json\n" +
+			"declare total is number\n" +
+			"set field \"total\" of doc to \"abc\"\n" +
+			"read field \"total\" of doc into total",
+		expected: `"abc" is not a number`,
+	},
+	"AssertCondition": {
+		bento: "start: declare total is number\n" +
+			"assert total > 0",
+		expected: "assertion failed: total > 0",
+	},
+	"AssertQuestion": {
+		bento:    "start: assert file \"tests/no-such-file\" exists",
+		expected: `assertion failed: file "tests/no-such-file" exists`,
+	},
+	"StopCannotBeHandled": {
+		bento: "start: try stop with status 3 and message \"bye\", " +
+			"on failure display \"caught\"\n" +
+			"display \"not reached\"",
+		expected: "bye",
+	},
+	"InvalidStopStatus": {
+		bento:    "start: stop with status 1.5",
+		expected: "status must be a whole number from 0 to 255, but got 1.5",
+	},
+}
+
+func TestVirtualMachine_Errors(t *testing.T) {
+	for testName, test := range vmErrorTests {
+		t.Run(testName, func(t *testing.T) {
+			parser := NewParser(strings.NewReader(test.bento))
+			program, err := parser.Parse()
+			require.NoError(t, err)
+
+			compiledProgram, err := NewCompiler(program).Compile()
+			require.NoError(t, err)
+
+			vm := NewVirtualMachine(compiledProgram)
+			vm.out = bytes.NewBuffer(nil)
+			err = vm.Run()
+
+			assert.EqualError(t, err, test.expected)
+		})
+	}
+}